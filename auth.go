@@ -0,0 +1,250 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2016, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// clientAuth derives the client-id of a request. the client-cert is
+// checked first (see -client-id), then the "Authorization" header:
+// a bearer token listed in -auth-tokens or basic credentials listed
+// in -auth-htpasswd. the client-id flows through -idmap and
+// -upload-clients as if it came from a client-cert.
+type clientAuth struct {
+	ClientID clientIDFunc // derives the client-id from the cert, see -client-id
+
+	mu       sync.RWMutex                 // guards tokens, htpasswd and verified, see Load()
+	tokens   map[[sha256.Size]byte]string // sha256(token) => client-id
+	htpasswd map[string]htpasswdEntry     // user => entry
+
+	verifiedMu sync.Mutex                   // guards the entries of verified
+	verified   map[string][sha256.Size]byte // user => sha256(password), see basicAuth()
+}
+
+type htpasswdEntry struct {
+	hash     []byte
+	clientID string
+}
+
+// authMethod tells how a client-id was derived
+type authMethod int
+
+const (
+	authNone authMethod = iota
+	authCert
+	authToken
+	authBasic
+)
+
+// of returns the client-id of 'r' and how it was derived. authNone
+// means 'r' carries no (valid) credentials. the client-id might be
+// empty for a client-cert lacking the -client-id source.
+func (ca *clientAuth) of(r *http.Request) (string, authMethod) {
+
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		return ca.ClientID.of(r.TLS.PeerCertificates[0]), authCert
+	}
+
+	ca.mu.RLock()
+	defer ca.mu.RUnlock()
+
+	if token := bearerToken(r); token != "" && ca.tokens != nil {
+		if clientID, ok := ca.tokens[sha256.Sum256([]byte(token))]; ok {
+			return clientID, authToken
+		}
+		return "", authNone
+	}
+
+	if user, password, ok := r.BasicAuth(); ok && ca.htpasswd != nil {
+		return ca.basicAuth(user, password)
+	}
+
+	return "", authNone
+}
+
+// basicAuth checks 'password' against the bcrypt hash of 'user'. bcrypt
+// is slow by design, a verified password is remembered to not pay the
+// price for each request of a client.
+func (ca *clientAuth) basicAuth(user, password string) (string, authMethod) {
+
+	entry, ok := ca.htpasswd[user]
+	if !ok {
+		return "", authNone
+	}
+
+	sum := sha256.Sum256([]byte(password))
+	ca.verifiedMu.Lock()
+	verified, ok := ca.verified[user]
+	ca.verifiedMu.Unlock()
+	if ok && verified == sum {
+		return entry.clientID, authBasic
+	}
+
+	if bcrypt.CompareHashAndPassword(entry.hash, []byte(password)) != nil {
+		return "", authNone
+	}
+
+	ca.verifiedMu.Lock()
+	ca.verified[user] = sum
+	ca.verifiedMu.Unlock()
+
+	return entry.clientID, authBasic
+}
+
+// challenge adds the "WWW-Authenticate" headers for the configured
+// authentication methods to 'w'
+func (ca *clientAuth) challenge(w http.ResponseWriter) {
+	ca.mu.RLock()
+	defer ca.mu.RUnlock()
+	if ca.tokens != nil {
+		w.Header().Add("WWW-Authenticate", `Bearer realm="kellner"`)
+	}
+	if ca.htpasswd != nil {
+		w.Header().Add("WWW-Authenticate", `Basic realm="kellner"`)
+	}
+}
+
+// authCredentials are the contents of -auth-tokens and -auth-htpasswd
+type authCredentials struct {
+	tokens   map[[sha256.Size]byte]string
+	htpasswd map[string]htpasswdEntry
+}
+
+// Load (re)loads -auth-tokens and -auth-htpasswd. an empty file name
+// disables the method.
+func (ca *clientAuth) Load(tokensFile, htpasswdFile string) error {
+	creds, err := loadAuthCredentials(tokensFile, htpasswdFile)
+	if err != nil {
+		return err
+	}
+	ca.Apply(creds)
+	return nil
+}
+
+// Apply replaces the current credentials by 'creds'
+func (ca *clientAuth) Apply(creds *authCredentials) {
+	ca.mu.Lock()
+	ca.tokens, ca.htpasswd = creds.tokens, creds.htpasswd
+	ca.verified = make(map[string][sha256.Size]byte)
+	ca.mu.Unlock()
+}
+
+func loadAuthCredentials(tokensFile, htpasswdFile string) (*authCredentials, error) {
+
+	var (
+		creds authCredentials
+		err   error
+	)
+
+	if tokensFile != "" {
+		if creds.tokens, err = loadTokens(tokensFile); err != nil {
+			return nil, fmt.Errorf("loading -auth-tokens: %v", err)
+		}
+	}
+	if htpasswdFile != "" {
+		if creds.htpasswd, err = loadHtpasswd(htpasswdFile); err != nil {
+			return nil, fmt.Errorf("loading -auth-htpasswd: %v", err)
+		}
+	}
+	return &creds, nil
+}
+
+func bearerToken(r *http.Request) string {
+	const prefix = "Bearer "
+	auth := r.Header.Get("Authorization")
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return ""
+	}
+	return strings.TrimSpace(auth[len(prefix):])
+}
+
+// loadTokens reads the tokens file: "<token> <client-id>" per line,
+// the token might be given as "sha256:<hex>" to not keep it in clear
+// text. empty lines and lines starting with '#' are ignored.
+func loadTokens(fileName string) (map[[sha256.Size]byte]string, error) {
+
+	var tokens = make(map[[sha256.Size]byte]string)
+
+	err := readAuthFile(fileName, func(lineNo int, line string) error {
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 || strings.TrimSpace(fields[1]) == "" {
+			return fmt.Errorf("line %d: expected \"<token> <client-id>\"", lineNo)
+		}
+
+		var sum [sha256.Size]byte
+		if hexSum := strings.TrimPrefix(fields[0], "sha256:"); hexSum != fields[0] {
+			raw, err := hex.DecodeString(hexSum)
+			if err != nil || len(raw) != sha256.Size {
+				return fmt.Errorf("line %d: invalid sha256 %q", lineNo, hexSum)
+			}
+			copy(sum[:], raw)
+		} else {
+			sum = sha256.Sum256([]byte(fields[0]))
+		}
+		tokens[sum] = strings.TrimSpace(fields[1])
+		return nil
+	})
+	return tokens, err
+}
+
+// loadHtpasswd reads an htpasswd file: "<user>:<bcrypt-hash>[:<client-id>]"
+// per line (eg. created by 'htpasswd -B'). without a client-id the user
+// is the client-id.
+func loadHtpasswd(fileName string) (map[string]htpasswdEntry, error) {
+
+	var entries = make(map[string]htpasswdEntry)
+
+	err := readAuthFile(fileName, func(lineNo int, line string) error {
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) < 2 || fields[0] == "" {
+			return fmt.Errorf("line %d: expected \"<user>:<bcrypt-hash>[:<client-id>]\"", lineNo)
+		}
+		if _, err := bcrypt.Cost([]byte(fields[1])); err != nil {
+			return fmt.Errorf("line %d: %q: only bcrypt hashes are supported: %v", lineNo, fields[0], err)
+		}
+		entry := htpasswdEntry{hash: []byte(fields[1]), clientID: fields[0]}
+		if len(fields) == 3 && strings.TrimSpace(fields[2]) != "" {
+			entry.clientID = strings.TrimSpace(fields[2])
+		}
+		entries[fields[0]] = entry
+		return nil
+	})
+	return entries, err
+}
+
+func readAuthFile(fileName string, parse func(lineNo int, line string) error) error {
+
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var scanner = bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err = parse(lineNo, line); err != nil {
+			return fmt.Errorf("%q: %v", fileName, err)
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,94 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2016, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestClientAuth(t *testing.T) {
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	writeFile := func(content string) string {
+		file, err := ioutil.TempFile("", "kellner-auth")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		file.WriteString(content)
+		return file.Name()
+	}
+
+	tokens := writeFile(fmt.Sprintf("# build hosts\ntoken1 O=SolSys,OU=Build,CN=docker\nsha256:%x O=Partner,CN=ci\n",
+		sha256.Sum256([]byte("token2"))))
+	defer os.Remove(tokens)
+	htpasswd := writeFile(fmt.Sprintf("joe:%s\nci:%s:O=Partner,CN=basic\n", hash, hash))
+	defer os.Remove(htpasswd)
+
+	auth := &clientAuth{}
+	if err := auth.Load(tokens, htpasswd); err != nil {
+		t.Fatal(err)
+	}
+
+	cert := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{
+		{Subject: pkix.Name{Names: []pkix.AttributeTypeAndValue{
+			{Type: asn1.ObjectIdentifier{2, 5, 4, 10}, Value: "SolSys"},
+			{Type: asn1.ObjectIdentifier{2, 5, 4, 3}, Value: "cert"},
+		}}},
+	}}
+
+	samples := []struct {
+		header string
+		tls    *tls.ConnectionState
+		id     string
+		method authMethod
+	}{
+		{"", nil, "", authNone},
+		{"Bearer token1", nil, "O=SolSys,OU=Build,CN=docker", authToken},
+		{"bearer token2", nil, "O=Partner,CN=ci", authToken},
+		{"Bearer token3", nil, "", authNone},
+		{"Basic am9lOnNlY3JldA==", nil, "joe", authBasic},              // joe:secret
+		{"Basic am9lOnNlY3JldA==", nil, "joe", authBasic},              // cached
+		{"Basic Y2k6c2VjcmV0", nil, "O=Partner,CN=basic", authBasic},   // ci:secret
+		{"Basic am9lOndyb25n", nil, "", authNone},                      // joe:wrong
+		{"Basic bWFyeTpzZWNyZXQ=", nil, "", authNone},                  // mary:secret
+		{"Bearer token1", cert, "O=SolSys,CN=cert", authCert},          // the cert wins
+		{"Basic am9lOnNlY3JldA==", cert, "O=SolSys,CN=cert", authCert}, // the cert wins
+	}
+
+	for i, sample := range samples {
+		r := httptest.NewRequest("GET", "/all/Packages", nil)
+		r.TLS = sample.tls
+		if sample.header != "" {
+			r.Header.Set("Authorization", sample.header)
+		}
+		id, method := auth.of(r)
+		if id != sample.id || method != sample.method {
+			t.Errorf("sample %d: expected %q (%d), got %q (%d)", i, sample.id, sample.method, id, method)
+		}
+	}
+
+	// a non-bcrypt hash is rejected
+	md5 := writeFile("joe:$apr1$aJ4b8Bqc$iLH4YpJQ1d0mTFAqEwJrX/\n")
+	defer os.Remove(md5)
+	if err := auth.Load("", md5); err == nil {
+		t.Errorf("expected an error for a non-bcrypt hash")
+	}
+}
@@ -0,0 +1,225 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2016, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// kellnerConfig is the content of a -config file (TOML). the top-level
+// keys are named like the command line flags:
+//
+//	root = "/srv/packages"
+//	tls-cert = "/etc/kellner/server.crt"
+//	workers = 8
+//	watch-delay = "5s"
+//
+// the tables [dir."<path>"] hold per-directory settings (see dirConfig).
+// <path> is relative to -root, the settings apply to the directory
+// and to all directories below it.
+type kellnerConfig struct {
+	Flags map[string]string // flag-name => value
+	Dirs  map[string]dirConfig
+
+	given map[string]bool // flags given on the command line, see applyTo()
+}
+
+// dirConfig holds the per-directory settings. unset settings are
+// inherited from the parent directory or the global settings.
+type dirConfig struct {
+	MD5       *bool   `toml:"md5"`
+	SHA1      *bool   `toml:"sha1"`
+	SHA256    *bool   `toml:"sha256"`
+	SignKey   *string `toml:"sign-key"`
+	GPGKey    *string `toml:"gpg-key"`
+	CheckDeps *bool   `toml:"check-deps"`
+}
+
+// flags which make no sense inside a config file
+var nonConfigFlags = map[string]bool{"config": true, "check-config": true}
+
+func loadConfig(file string, flags *flag.FlagSet) (*kellnerConfig, error) {
+
+	var raw map[string]interface{}
+	if _, err := toml.DecodeFile(file, &raw); err != nil {
+		return nil, err
+	}
+
+	var cfg = &kellnerConfig{Flags: make(map[string]string)}
+	for key, value := range raw {
+		if key == "dir" {
+			continue
+		}
+		if nonConfigFlags[key] || flags.Lookup(key) == nil {
+			return nil, fmt.Errorf("%s: unknown setting %q", file, key)
+		}
+		switch value.(type) {
+		case string, bool, int64, float64:
+			cfg.Flags[key] = fmt.Sprint(value)
+		default:
+			return nil, fmt.Errorf("%s: unsupported value for %q: %v", file, key, value)
+		}
+	}
+
+	var dirs struct {
+		Dir map[string]dirConfig `toml:"dir"`
+	}
+	md, err := toml.DecodeFile(file, &dirs)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range md.Undecoded() {
+		if len(key) > 0 && key[0] == "dir" {
+			return nil, fmt.Errorf("%s: unknown setting %q", file, key.String())
+		}
+	}
+
+	cfg.Dirs = make(map[string]dirConfig)
+	for name, dc := range dirs.Dir {
+		var clean = path.Clean(strings.TrimPrefix(name, "./"))
+		if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+			return nil, fmt.Errorf("%s: [dir.%q] must be relative to -root", file, name)
+		}
+		cfg.Dirs[clean] = dc
+	}
+
+	return cfg, nil
+}
+
+// applyTo sets all flags of 'flags' which were not given on the
+// command line: command line flags override the config file.
+func (cfg *kellnerConfig) applyTo(flags *flag.FlagSet) error {
+
+	if cfg.given == nil {
+		cfg.given = make(map[string]bool)
+		flags.Visit(func(f *flag.Flag) { cfg.given[f.Name] = true })
+	}
+
+	for name, value := range cfg.Flags {
+		if cfg.given[name] {
+			continue
+		}
+		if err := flags.Set(name, value); err != nil {
+			return fmt.Errorf("setting %q to %q: %v", name, value, err)
+		}
+	}
+	return nil
+}
+
+// value returns the effective value of the flag 'name': the command
+// line wins over the config file which wins over the default
+func (cfg *kellnerConfig) value(flags *flag.FlagSet, name string) string {
+	var f = flags.Lookup(name)
+	if cfg.given[name] {
+		return f.Value.String()
+	}
+	if value, exists := cfg.Flags[name]; exists {
+		return value
+	}
+	return f.DefValue
+}
+
+// setupDirs creates the per-directory scanOptions in opts.dirs.
+// 'signKey' and 'gpgKey' name the global key files.
+func (cfg *kellnerConfig) setupDirs(opts *scanOptions, signKey, gpgKey string) error {
+
+	var paths = make([]string, 0, len(cfg.Dirs))
+	for name := range cfg.Dirs {
+		paths = append(paths, name)
+	}
+	// parents first, they pass on their settings
+	sort.Slice(paths, func(i, j int) bool { return len(paths[i]) < len(paths[j]) })
+
+	for _, name := range paths {
+
+		var (
+			dc     = cfg.Dirs[name]
+			parent = opts.dirFor(name)
+			dir    = dirScanOptions{path: name, signKey: signKey, gpgKey: gpgKey}
+			dopts  = *opts
+			err    error
+		)
+		if parent != nil {
+			dopts = *parent.opts
+			dir.signKey, dir.gpgKey = parent.signKey, parent.gpgKey
+		}
+		dopts.dirs = nil
+
+		if dc.MD5 != nil {
+			dopts.doMD5 = *dc.MD5
+		}
+		if dc.SHA1 != nil {
+			dopts.doSHA1 = *dc.SHA1
+		}
+		if dc.SHA256 != nil {
+			dopts.doSHA256 = *dc.SHA256
+		}
+		if dc.CheckDeps != nil {
+			dopts.checkDeps = *dc.CheckDeps
+		}
+		if dc.SignKey != nil {
+			dir.signKey, dopts.usignKey = *dc.SignKey, nil
+			if dir.signKey != "" {
+				if dopts.usignKey, err = loadUsignKey(dir.signKey); err != nil {
+					return fmt.Errorf("[dir.%q] sign-key: %v", name, err)
+				}
+			}
+		}
+		if dc.GPGKey != nil {
+			dir.gpgKey, dopts.pgpKey = *dc.GPGKey, nil
+			if dir.gpgKey != "" {
+				if dopts.pgpKey, err = loadPGPKey(dir.gpgKey); err != nil {
+					return fmt.Errorf("[dir.%q] gpg-key: %v", name, err)
+				}
+			}
+		}
+
+		dir.opts = &dopts
+		// keep the longest paths first, see dirFor()
+		opts.dirs = append([]dirScanOptions{dir}, opts.dirs...)
+	}
+	return nil
+}
+
+// printConfigTo writes the effective configuration as TOML to 'w'
+func printConfigTo(w io.Writer, flags *flag.FlagSet, opts *scanOptions) {
+
+	flags.VisitAll(func(f *flag.Flag) {
+		if nonConfigFlags[f.Name] {
+			return
+		}
+		var value = fmt.Sprintf("%q", f.Value.String())
+		if getter, ok := f.Value.(flag.Getter); ok {
+			switch getter.Get().(type) {
+			case bool, int, int64, uint, uint64, float64:
+				value = f.Value.String()
+			}
+		}
+		fmt.Fprintf(w, "%s = %s\n", f.Name, value)
+	})
+
+	var dirs = append([]dirScanOptions(nil), opts.dirs...)
+	sort.Slice(dirs, func(i, j int) bool { return dirs[i].path < dirs[j].path })
+	for _, dir := range dirs {
+		fmt.Fprintf(w, "\n[dir.%q]\n", dir.path)
+		fmt.Fprintf(w, "md5 = %t\n", dir.opts.doMD5)
+		fmt.Fprintf(w, "sha1 = %t\n", dir.opts.doSHA1)
+		fmt.Fprintf(w, "sha256 = %t\n", dir.opts.doSHA256)
+		fmt.Fprintf(w, "sign-key = %q\n", dir.signKey)
+		fmt.Fprintf(w, "gpg-key = %q\n", dir.gpgKey)
+		fmt.Fprintf(w, "check-deps = %t\n", dir.opts.checkDeps)
+	}
+}
@@ -0,0 +1,79 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2016, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestConfig(t *testing.T) {
+
+	file, err := ioutil.TempFile("", "kellner-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(`
+root = "/srv/packages"
+workers = 8
+md5 = false
+
+[dir."stable"]
+sha256 = true
+
+[dir."stable/core2-64/"]
+md5 = true
+`)
+	file.Close()
+
+	var (
+		flags   = flag.NewFlagSet("kellner", flag.ContinueOnError)
+		root    = flags.String("root", "", "")
+		workers = flags.Int("workers", 4, "")
+		md5     = flags.Bool("md5", true, "")
+	)
+	flags.Parse([]string{"-workers", "2"})
+
+	cfg, err := loadConfig(file.Name(), flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cfg.applyTo(flags); err != nil {
+		t.Fatal(err)
+	}
+	if *root != "/srv/packages" || *workers != 2 || *md5 {
+		t.Fatalf("expected root=/srv/packages, workers=2, md5=false, got %q, %d, %t", *root, *workers, *md5)
+	}
+
+	var opts = scanOptions{doMD5: *md5}
+	if err = cfg.setupDirs(&opts, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		dir         string
+		md5, sha256 bool
+	}{
+		{".", false, false},
+		{"testing", false, false},
+		{"stable", false, true},
+		{"stable/all", false, true},
+		{"stable/core2-64", true, true},
+		{"stable/core2-64/extra", true, true},
+		{"stable-old", false, false},
+	} {
+		dopts := opts.forDir(test.dir)
+		if dopts.doMD5 != test.md5 || dopts.doSHA256 != test.sha256 {
+			t.Errorf("%s: expected md5=%t sha256=%t, got md5=%t sha256=%t",
+				test.dir, test.md5, test.sha256, dopts.doMD5, dopts.doSHA256)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2016, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+)
+
+// how often the CRL files are checked for changes
+const _CRLCheckInterval = time.Minute
+
+// crlSet holds the revoked certificates of a list of CRL files (-tls-crl).
+// each CRL must be signed by one of the client CAs.
+type crlSet struct {
+	files    []string
+	modTimes []time.Time
+	revoked  map[string]map[string]time.Time // raw issuer => serial => revocation time
+}
+
+func loadCRLs(files []string, cas []*x509.Certificate) (*crlSet, error) {
+
+	var set = &crlSet{
+		files:   files,
+		revoked: make(map[string]map[string]time.Time),
+	}
+
+	for _, file := range files {
+
+		fi, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		set.modTimes = append(set.modTimes, fi.ModTime())
+
+		crls, err := readCRLFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, crl := range crls {
+			if !crlSignedByAny(crl, cas) {
+				return nil, fmt.Errorf("crl %q: not signed by any of the client CAs", file)
+			}
+			if !crl.NextUpdate.IsZero() && crl.NextUpdate.Before(time.Now()) {
+				log.Printf("warning: crl %q: outdated since %s", file, crl.NextUpdate.Format(time.RFC3339))
+			}
+
+			var issuer = string(crl.RawIssuer)
+			if set.revoked[issuer] == nil {
+				set.revoked[issuer] = make(map[string]time.Time)
+			}
+			for _, entry := range crl.RevokedCertificateEntries {
+				set.revoked[issuer][entry.SerialNumber.String()] = entry.RevocationTime
+			}
+		}
+	}
+	return set, nil
+}
+
+// readCRLFile reads all CRLs in 'file'. 'file' is either PEM encoded
+// (containing one or more "X509 CRL" blocks) or a single DER encoded CRL.
+func readCRLFile(file string) ([]*x509.RevocationList, error) {
+
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var crls []*x509.RevocationList
+
+	if !bytes.Contains(raw, []byte("-----BEGIN")) {
+		crl, err := x509.ParseRevocationList(raw)
+		if err != nil {
+			return nil, fmt.Errorf("crl %q: %v", file, err)
+		}
+		return append(crls, crl), nil
+	}
+
+	for block, rest := pem.Decode(raw); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "X509 CRL" {
+			continue
+		}
+		crl, err := x509.ParseRevocationList(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("crl %q: %v", file, err)
+		}
+		crls = append(crls, crl)
+	}
+	if len(crls) == 0 {
+		return nil, fmt.Errorf("crl %q: no \"X509 CRL\" found", file)
+	}
+	return crls, nil
+}
+
+func crlSignedByAny(crl *x509.RevocationList, cas []*x509.Certificate) bool {
+	for _, ca := range cas {
+		if bytes.Equal(ca.RawSubject, crl.RawIssuer) && crl.CheckSignatureFrom(ca) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// isRevoked returns the revocation time of 'cert' and true if
+// 'cert' is revoked
+func (set *crlSet) isRevoked(cert *x509.Certificate) (time.Time, bool) {
+	at, revoked := set.revoked[string(cert.RawIssuer)][cert.SerialNumber.String()]
+	return at, revoked
+}
+
+// changed returns true if any of the CRL files was modified since loading
+func (set *crlSet) changed() bool {
+	for i, file := range set.files {
+		fi, err := os.Stat(file)
+		if err != nil || !fi.ModTime().Equal(set.modTimes[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// nrevoked returns the number of revoked certificates
+func (set *crlSet) nrevoked() int {
+	var n int
+	for _, serials := range set.revoked {
+		n += len(serials)
+	}
+	return n
+}
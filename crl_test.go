@@ -0,0 +1,93 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2016, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCRL(t *testing.T) {
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	mkCert := func(serial int64, name string, parent *x509.Certificate) *x509.Certificate {
+		tmpl := &x509.Certificate{
+			SerialNumber:          big.NewInt(serial),
+			Subject:               pkix.Name{CommonName: name},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(time.Hour),
+			IsCA:                  parent == nil,
+			BasicConstraintsValid: true,
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		}
+		if parent == nil {
+			parent = tmpl
+		}
+		raw, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, _ := x509.ParseCertificate(raw)
+		return cert
+	}
+
+	var (
+		ca      = mkCert(1, "ca", nil)
+		other   = mkCert(1, "other-ca", nil)
+		revoked = mkCert(2, "revoked", ca)
+		valid   = mkCert(3, "valid", ca)
+	)
+
+	raw, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now(),
+		NextUpdate: time.Now().Add(time.Hour),
+		RevokedCertificateEntries: []x509.RevocationListEntry{
+			{SerialNumber: big.NewInt(2), RevocationTime: time.Now()},
+		},
+	}, ca, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := ioutil.TempFile("", "kellner-crl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	pem.Encode(file, &pem.Block{Type: "X509 CRL", Bytes: raw})
+	file.Close()
+
+	if _, err = loadCRLs([]string{file.Name()}, []*x509.Certificate{other}); err == nil {
+		t.Fatalf("expected an error for a crl not signed by a client-ca")
+	}
+
+	set, err := loadCRLs([]string{file.Name()}, []*x509.Certificate{other, ca})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, isRevoked := set.isRevoked(revoked); !isRevoked {
+		t.Errorf("expected %q to be revoked", revoked.Subject.CommonName)
+	}
+	if _, isRevoked := set.isRevoked(valid); isRevoked {
+		t.Errorf("expected %q to be valid", valid.Subject.CommonName)
+	}
+	if set.changed() {
+		t.Errorf("expected the crl to be unchanged")
+	}
+}
@@ -0,0 +1,76 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2016, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// zstdReadCloser adapts zstd.Decoder to io.ReadCloser, zstd.Decoder.Close()
+// does not return an error.
+type zstdReadCloser struct{ *zstd.Decoder }
+
+func (z zstdReadCloser) Close() error {
+	z.Decoder.Close()
+	return nil
+}
+
+// decompressReader returns a reader which decompresses 'r' based upon
+// the extension of 'name': ".gz", ".xz", ".zst", ".bz2" or, for anything
+// else, no compression at all.
+func decompressReader(name string, r io.Reader) (io.ReadCloser, error) {
+	switch path.Ext(name) {
+	case ".gz":
+		return gzip.NewReader(r)
+	case ".xz":
+		xzReader, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(xzReader), nil
+	case ".zst":
+		zstReader, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return zstdReadCloser{zstReader}, nil
+	case ".bz2":
+		return ioutil.NopCloser(bzip2.NewReader(r)), nil
+	}
+	return ioutil.NopCloser(r), nil
+}
+
+// compressWriter is the counterpart of decompressReader: it returns a
+// writer which compresses to 'w' based upon the extension of 'name'.
+// bzip2 is not supported. Close() does not close 'w'.
+func compressWriter(name string, w io.Writer) (io.WriteCloser, error) {
+	switch path.Ext(name) {
+	case ".gz":
+		return gzip.NewWriterLevel(w, gzip.BestCompression)
+	case ".xz":
+		return xz.NewWriter(w)
+	case ".zst":
+		return zstd.NewWriter(w)
+	case ".bz2":
+		return nil, fmt.Errorf("bzip2 compression is not supported")
+	}
+	return nopWriteCloser{w}, nil
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
@@ -0,0 +1,482 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2016, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// depRelation is one alternative of a relationship field, eg.
+// "libc6 (>= 2.19)", see
+// https://www.debian.org/doc/debian-policy/ch-relationships.html
+type depRelation struct {
+	Name    string
+	Op      string // one of "", "<<", "<=", "=", ">=", ">>"
+	Version string
+}
+
+// depClause is a list of alternatives, eg. "mawk | gawk"
+type depClause []depRelation
+
+func (rel depRelation) String() string {
+	if rel.Op == "" {
+		return rel.Name
+	}
+	return fmt.Sprintf("%s (%s %s)", rel.Name, rel.Op, rel.Version)
+}
+
+func (clause depClause) String() string {
+	var alts = make([]string, len(clause))
+	for i := range clause {
+		alts[i] = clause[i].String()
+	}
+	return strings.Join(alts, " | ")
+}
+
+// parseRelations parses the content of a relationship field like
+// "Depends" or "Provides": "a (>= 1.0), b | c, d:any"
+func parseRelations(field string) ([]depClause, error) {
+
+	var clauses []depClause
+	for _, rawClause := range strings.Split(field, ",") {
+		if strings.TrimSpace(rawClause) == "" {
+			continue
+		}
+		var clause depClause
+		for _, rawRel := range strings.Split(rawClause, "|") {
+			rel, err := parseRelation(rawRel)
+			if err != nil {
+				return nil, err
+			}
+			clause = append(clause, rel)
+		}
+		clauses = append(clauses, clause)
+	}
+	return clauses, nil
+}
+
+func parseRelation(raw string) (depRelation, error) {
+
+	var rel depRelation
+
+	raw = strings.TrimSpace(raw)
+	if idx := strings.IndexAny(raw, "(["); idx >= 0 {
+		rel.Name = strings.TrimSpace(raw[:idx])
+		raw = raw[idx:]
+	} else {
+		rel.Name, raw = raw, ""
+	}
+
+	// "foo:any", "foo:native": the architecture qualifier does not matter here
+	if idx := strings.IndexByte(rel.Name, ':'); idx >= 0 {
+		rel.Name = rel.Name[:idx]
+	}
+	if rel.Name == "" || strings.ContainsAny(rel.Name, " \t") {
+		return rel, fmt.Errorf("invalid package name in %q", raw)
+	}
+
+	if !strings.HasPrefix(raw, "(") {
+		return rel, nil
+	}
+	var end = strings.IndexByte(raw, ')')
+	if end < 0 {
+		return rel, fmt.Errorf("missing ')' in %q", raw)
+	}
+	var constraint = strings.TrimSpace(raw[1:end])
+	var opEnd = strings.IndexFunc(constraint, func(r rune) bool {
+		return r != '<' && r != '>' && r != '='
+	})
+	if opEnd <= 0 {
+		return rel, fmt.Errorf("missing version operator in %q", raw)
+	}
+
+	rel.Op = constraint[:opEnd]
+	rel.Version = strings.TrimSpace(constraint[opEnd:])
+	switch rel.Op {
+	case "<<", "<=", "=", ">=", ">>":
+	case "<": // deprecated, means "<="
+		rel.Op = "<="
+	case ">": // deprecated, means ">="
+		rel.Op = ">="
+	default:
+		return rel, fmt.Errorf("unknown version operator %q", rel.Op)
+	}
+	if rel.Version == "" {
+		return rel, fmt.Errorf("missing version in %q", raw)
+	}
+	return rel, nil
+}
+
+// satisfiedBy returns true if 'version' meets the version
+// constraint of 'rel'
+func (rel depRelation) satisfiedBy(version string) bool {
+	if rel.Op == "" {
+		return true
+	}
+	var rc = compareVersion(version, rel.Version)
+	switch rel.Op {
+	case "<<":
+		return rc < 0
+	case "<=":
+		return rc <= 0
+	case "=":
+		return rc == 0
+	case ">=":
+		return rc >= 0
+	case ">>":
+		return rc > 0
+	}
+	return false
+}
+
+// depUniverse holds all packages available to satisfy dependencies
+type depUniverse struct {
+	packages map[string][]*ipkArchive // by "Package"
+	provides map[string][]depProvider // by provided name
+}
+
+type depProvider struct {
+	pkg     *ipkArchive
+	version string // empty for unversioned provides
+}
+
+func newDepUniverse(indices ...*packageIndex) *depUniverse {
+
+	var u = &depUniverse{
+		packages: make(map[string][]*ipkArchive),
+		provides: make(map[string][]depProvider),
+	}
+	for _, pi := range indices {
+		for _, pkg := range pi.Entries {
+			var name = pkg.Header["Package"]
+			u.packages[name] = append(u.packages[name], pkg)
+
+			provides, _ := parseRelations(pkg.Header["Provides"])
+			for _, clause := range provides {
+				for _, rel := range clause {
+					u.provides[rel.Name] = append(u.provides[rel.Name], depProvider{pkg, rel.Version})
+				}
+			}
+		}
+	}
+	return u
+}
+
+// candidates returns all packages satisfying 'rel'. versioned relations
+// are only satisfied by real packages or versioned provides.
+func (u *depUniverse) candidates(rel depRelation) []*ipkArchive {
+
+	var found []*ipkArchive
+	for _, pkg := range u.packages[rel.Name] {
+		if rel.satisfiedBy(pkg.Header["Version"]) {
+			found = append(found, pkg)
+		}
+	}
+	for _, p := range u.provides[rel.Name] {
+		if rel.Op == "" || (p.version != "" && rel.satisfiedBy(p.version)) {
+			found = append(found, p.pkg)
+		}
+	}
+	return found
+}
+
+// conflicts returns true if 'a' declares a conflict with 'b' or vice versa
+func conflicts(a, b *ipkArchive) bool {
+	return declaresConflict(a, b) || declaresConflict(b, a)
+}
+
+func declaresConflict(a, b *ipkArchive) bool {
+	if a == b {
+		return false
+	}
+	var clauses, _ = parseRelations(a.Header["Conflicts"])
+	var provided, _ = parseRelations(b.Header["Provides"])
+	for _, clause := range clauses {
+		for _, rel := range clause {
+			if rel.Name == b.Header["Package"] && rel.satisfiedBy(b.Header["Version"]) {
+				return true
+			}
+			for _, clause := range provided {
+				for _, p := range clause {
+					if rel.Op == "" && p.Name == rel.Name {
+						return true
+					}
+				}
+			}
+		}
+	}
+	return false
+}
+
+// depProblem describes an unsatisfiable relationship of a package
+type depProblem struct {
+	Package  string
+	Version  string
+	Filename string
+	Field    string
+	Relation string
+	Reason   string
+	Severity string // "error" or "warning"
+}
+
+func (p depProblem) String() string {
+	return fmt.Sprintf("%s (%s) %s: %s: %s",
+		p.Package, p.Version, p.Field, p.Relation, p.Reason)
+}
+
+// the fields which are checked by depUniverse.check() and the severity
+// of a not satisfiable relationship
+var depFields = []struct{ name, severity string }{
+	{"Pre-Depends", "error"},
+	{"Depends", "error"},
+	{"Recommends", "warning"},
+}
+
+// check validates the relationships of all packages in 'pi' against
+// the packages in 'u'
+func (u *depUniverse) check(pi *packageIndex) []depProblem {
+
+	var problems []depProblem
+	for _, name := range pi.SortedNames() {
+		var pkg = pi.Entries[name]
+		var problem = depProblem{
+			Package:  pkg.Header["Package"],
+			Version:  pkg.Header["Version"],
+			Filename: pkg.Name,
+		}
+
+		for _, field := range depFields {
+			problem.Field, problem.Severity = field.name, field.severity
+
+			clauses, err := parseRelations(pkg.Header[field.name])
+			if err != nil {
+				problem.Relation, problem.Reason = pkg.Header[field.name], err.Error()
+				problems = append(problems, problem)
+				continue
+			}
+
+			for _, clause := range clauses {
+				if reason := u.unsatisfied(pkg, clause); reason != "" {
+					problem.Relation, problem.Reason = clause.String(), reason
+					problems = append(problems, problem)
+				}
+			}
+		}
+	}
+	return problems
+}
+
+// archCompatible returns true if 'pkg' can satisfy a dependency of a
+// package built for 'arch'. "all" (or no architecture at all) fits
+// every architecture.
+func archCompatible(pkg *ipkArchive, arch string) bool {
+	var pkgArch = pkg.Header["Architecture"]
+	return arch == "" || arch == "all" || pkgArch == "" || pkgArch == "all" || pkgArch == arch
+}
+
+// unsatisfied returns why 'clause' of 'pkg' can't be satisfied or ""
+// if it can
+func (u *depUniverse) unsatisfied(pkg *ipkArchive, clause depClause) string {
+
+	var arch = pkg.Header["Architecture"]
+	var nonConflicting, candidates, names, otherArch int
+	for _, rel := range clause {
+		names += len(u.provides[rel.Name])
+		for _, p := range u.packages[rel.Name] {
+			if archCompatible(p, arch) {
+				names++
+			} else {
+				otherArch++
+			}
+		}
+		for _, c := range u.candidates(rel) {
+			if !archCompatible(c, arch) {
+				continue
+			}
+			candidates++
+			if !conflicts(pkg, c) {
+				nonConflicting++
+			}
+		}
+	}
+
+	switch {
+	case nonConflicting > 0:
+		return ""
+	case candidates > 0:
+		return "only satisfiable by conflicting packages"
+	case names > 0:
+		return "no matching version available"
+	case otherArch > 0:
+		return "not available for " + arch
+	}
+	return "not available"
+}
+
+// closure resolves the packages 'names' and everything they depend on
+// (Pre-Depends and Depends). of all candidates matching the architecture
+// of the depending package (or "all") the newest version which does not
+// conflict with the already picked packages is picked. there is no
+// backtracking: if a pick turns out to be wrong later on the
+// resolution fails with an explanation.
+func (u *depUniverse) closure(names []string) ([]*ipkArchive, error) {
+
+	var (
+		picked = make(map[string]*ipkArchive)      // by condenseKey()
+		parent = make(map[*ipkArchive]*ipkArchive) // who pulled in a package
+		queue  []*ipkArchive
+	)
+
+	for _, name := range names {
+		var clause = depClause{{Name: name}}
+		pkg, err := u.resolve(clause, "", picked)
+		if err != nil {
+			return nil, fmt.Errorf("can't resolve requested package %q: %v", name, err)
+		}
+		if pkg != nil {
+			picked[condenseKey(pkg)] = pkg
+			queue = append(queue, pkg)
+		}
+	}
+
+	// chain explains why 'pkg' is part of the closure
+	chain := func(pkg *ipkArchive) string {
+		var labels []string
+		for ; pkg != nil; pkg = parent[pkg] {
+			labels = append(labels, fmt.Sprintf("%s (%s)", pkg.Header["Package"], pkg.Header["Version"]))
+		}
+		return strings.Join(labels, " <- ")
+	}
+
+	for len(queue) > 0 {
+		var pkg = queue[0]
+		queue = queue[1:]
+
+		for _, field := range depFields {
+			if field.severity != "error" {
+				continue
+			}
+			clauses, err := parseRelations(pkg.Header[field.name])
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s: %v", chain(pkg), field.name, err)
+			}
+			for _, clause := range clauses {
+				dep, err := u.resolve(clause, pkg.Header["Architecture"], picked)
+				if err != nil {
+					return nil, fmt.Errorf("can't resolve %q (%s of %s): %v",
+						clause.String(), field.name, chain(pkg), err)
+				}
+				if dep != nil {
+					picked[condenseKey(dep)] = dep
+					parent[dep] = pkg
+					queue = append(queue, dep)
+				}
+			}
+		}
+	}
+
+	var pkgs = make([]*ipkArchive, 0, len(picked))
+	for _, key := range sortedKeys(picked) {
+		pkgs = append(pkgs, picked[key])
+	}
+	return pkgs, nil
+}
+
+// resolve returns the newest package for 'arch' (see archCompatible())
+// satisfying 'clause' which does not conflict with any of the 'picked'
+// packages. if 'clause' is already satisfied by one of the 'picked'
+// packages, nil is returned.
+func (u *depUniverse) resolve(clause depClause, arch string, picked map[string]*ipkArchive) (*ipkArchive, error) {
+
+	var reasons []string
+	for _, rel := range clause {
+		for _, c := range u.candidates(rel) {
+			if archCompatible(c, arch) && picked[condenseKey(c)] == c {
+				return nil, nil
+			}
+		}
+	}
+
+	for _, rel := range clause {
+		if p := pickedFor(picked, rel.Name, arch); p != nil && !rel.satisfiedBy(p.Header["Version"]) {
+			reasons = append(reasons, fmt.Sprintf("%s (%s) is already picked", rel.Name, p.Header["Version"]))
+			continue
+		}
+
+		var candidates []*ipkArchive
+		for _, c := range u.candidates(rel) {
+			if archCompatible(c, arch) {
+				candidates = append(candidates, c)
+			}
+		}
+		sort.Slice(candidates, func(i, j int) bool {
+			return compareVersion(candidates[i].Header["Version"], candidates[j].Header["Version"]) > 0
+		})
+
+	nextCandidate:
+		for _, c := range candidates {
+			if _, exists := picked[condenseKey(c)]; exists {
+				continue
+			}
+			for _, p := range picked {
+				if conflicts(c, p) {
+					reasons = append(reasons, fmt.Sprintf("%s (%s) conflicts with %s (%s)",
+						c.Header["Package"], c.Header["Version"], p.Header["Package"], p.Header["Version"]))
+					continue nextCandidate
+				}
+			}
+			return c, nil
+		}
+
+		if len(candidates) == 0 {
+			reasons = append(reasons, u.availability(rel, arch))
+		}
+	}
+	return nil, fmt.Errorf("%s", strings.Join(reasons, "; "))
+}
+
+// pickedFor returns the picked package 'name' usable for 'arch' or nil
+func pickedFor(picked map[string]*ipkArchive, name, arch string) *ipkArchive {
+	for _, p := range picked {
+		if p.Header["Package"] == name && archCompatible(p, arch) {
+			return p
+		}
+	}
+	return nil
+}
+
+// availability explains why there is no candidate for 'rel' and 'arch'
+func (u *depUniverse) availability(rel depRelation, arch string) string {
+	var versions []string
+	for _, pkg := range u.packages[rel.Name] {
+		if archCompatible(pkg, arch) {
+			versions = append(versions, pkg.Header["Version"])
+		}
+	}
+	if len(versions) == 0 && len(u.packages[rel.Name]) > 0 {
+		return fmt.Sprintf("%s is not available for %s", rel.Name, arch)
+	}
+	if len(versions) == 0 {
+		return fmt.Sprintf("%s is not available", rel.Name)
+	}
+	sort.Strings(versions)
+	return fmt.Sprintf("%s: no matching version available (available: %s)",
+		rel, strings.Join(versions, ", "))
+}
+
+func sortedKeys(m map[string]*ipkArchive) []string {
+	var keys = make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,257 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2016, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseRelations(t *testing.T) {
+
+	clauses, err := parseRelations("a (>= 1.0), b | c (<< 2:1.0-r1), d:any, e (> 1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []depClause{
+		{{"a", ">=", "1.0"}},
+		{{"b", "", ""}, {"c", "<<", "2:1.0-r1"}},
+		{{"d", "", ""}},
+		{{"e", ">=", "1"}},
+	}
+	if !reflect.DeepEqual(clauses, expected) {
+		t.Fatalf("expected %v, got %v", expected, clauses)
+	}
+
+	for _, invalid := range []string{"a (>= 1.0", "a (1.0)", "a (=> 1.0)", "a (>=)"} {
+		if _, err := parseRelations(invalid); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestDepUniverseCheck(t *testing.T) {
+
+	pi, err := readPackageIndex(strings.NewReader(`Package: libfoo
+Version: 1.0
+Provides: foo-api (= 2)
+Filename: libfoo_1.0_all.ipk
+
+Package: app
+Version: 1.0
+Depends: libfoo (>= 1.0), foo-api (>= 2), missing | libfoo (>> 1.0)
+Filename: app_1.0_all.ipk
+
+Package: tool
+Version: 1.0
+Depends: app
+Conflicts: app
+Filename: tool_1.0_all.ipk
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	problems := newDepUniverse(pi).check(pi)
+	reasons := make(map[string]string)
+	for _, p := range problems {
+		reasons[p.Package+" "+p.Relation] = p.Reason
+	}
+	expected := map[string]string{
+		"app missing | libfoo (>> 1.0)": "no matching version available",
+		"tool app":                      "only satisfiable by conflicting packages",
+	}
+	if !reflect.DeepEqual(reasons, expected) {
+		t.Fatalf("expected %v, got %v", expected, reasons)
+	}
+}
+
+func TestDepUniverseClosure(t *testing.T) {
+
+	pi, err := readPackageIndex(strings.NewReader(`Package: libfoo
+Version: 1.0
+Filename: libfoo_1.0_all.ipk
+
+Package: libfoo
+Version: 2.0
+Conflicts: libbaz
+Filename: libfoo_2.0_all.ipk
+
+Package: libbaz
+Version: 1.0
+Filename: libbaz_1.0_all.ipk
+
+Package: app
+Version: 1.0
+Depends: libbaz, libfoo (>= 1.0)
+Filename: app_1.0_all.ipk
+
+Package: tool
+Version: 1.0
+Depends: libfoo (>= 3)
+Filename: tool_1.0_all.ipk
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var u = newDepUniverse(pi)
+	closure, err := u.closure([]string{"app"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var picked []string
+	for _, pkg := range closure {
+		picked = append(picked, pkg.Header["Package"]+"_"+pkg.Header["Version"])
+	}
+	expected := []string{"app_1.0", "libbaz_1.0", "libfoo_1.0"}
+	if !reflect.DeepEqual(picked, expected) {
+		t.Fatalf("expected %v, got %v", expected, picked)
+	}
+
+	if _, err = u.closure([]string{"tool"}); err == nil || !strings.Contains(err.Error(), "tool (1.0)") {
+		t.Fatalf("expected an error mentioning 'tool (1.0)', got %v", err)
+	}
+}
+
+// in an index of mixed architectures dependencies are resolved by
+// packages of the same architecture (or "all")
+func TestDepUniverseClosureMixedArch(t *testing.T) {
+
+	pi, err := readPackageIndex(strings.NewReader(`Package: libfoo
+Version: 2.0
+Architecture: x86_64
+Filename: libfoo_2.0_x86_64.ipk
+
+Package: libfoo
+Version: 1.0
+Architecture: armv7
+Filename: libfoo_1.0_armv7.ipk
+
+Package: base-files
+Version: 1.0
+Architecture: all
+Filename: base-files_1.0_all.ipk
+
+Package: app
+Version: 1.0
+Architecture: armv7
+Depends: libfoo, base-files
+Filename: app_1.0_armv7.ipk
+
+Package: app
+Version: 1.0
+Architecture: x86_64
+Depends: libfoo
+Filename: app_1.0_x86_64.ipk
+
+Package: suite
+Version: 1.0
+Architecture: all
+Depends: app-armv7, app-x86
+Filename: suite_1.0_all.ipk
+
+Package: app-armv7
+Version: 1.0
+Architecture: armv7
+Depends: libfoo
+Filename: app-armv7_1.0_armv7.ipk
+
+Package: app-x86
+Version: 1.0
+Architecture: x86_64
+Depends: libfoo
+Filename: app-x86_1.0_x86_64.ipk
+
+Package: libbar
+Version: 1.0
+Architecture: x86_64
+Filename: libbar_1.0_x86_64.ipk
+
+Package: tool
+Version: 1.0
+Architecture: armv7
+Depends: libbar
+Filename: tool_1.0_armv7.ipk
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var u = newDepUniverse(pi)
+	samples := []struct {
+		names    []string
+		expected []string
+	}{
+		{[]string{"app-armv7"}, []string{"app-armv7_1.0_armv7", "libfoo_1.0_armv7"}},
+		// the picked libfoo for armv7 must not shadow the one for x86_64
+		{[]string{"suite"}, []string{"suite_1.0_all", "app-armv7_1.0_armv7", "libfoo_1.0_armv7",
+			"app-x86_1.0_x86_64", "libfoo_2.0_x86_64"}},
+	}
+	for _, sample := range samples {
+		closure, err := u.closure(sample.names)
+		if err != nil {
+			t.Fatalf("%v: %v", sample.names, err)
+		}
+		var picked []string
+		for _, pkg := range closure {
+			picked = append(picked, pkg.Header["Package"]+"_"+pkg.Header["Version"]+"_"+pkg.Header["Architecture"])
+		}
+		if !reflect.DeepEqual(picked, sample.expected) {
+			t.Errorf("%v: expected %v, got %v", sample.names, sample.expected, picked)
+		}
+	}
+
+	if _, err = u.closure([]string{"tool"}); err == nil || !strings.Contains(err.Error(), "not available for armv7") {
+		t.Errorf("expected an error about libbar not being available for armv7, got %v", err)
+	}
+
+	problems := newDepUniverse(pi).check(pi)
+	if len(problems) != 1 || problems[0].Package != "tool" || problems[0].Reason != "not available for armv7" {
+		t.Errorf("expected only the dependency of 'tool' on 'libbar' to fail, got %v", problems)
+	}
+}
+
+// a virtual package provided by any alternative of a Provides clause
+// conflicts
+func TestDeclaresConflict(t *testing.T) {
+
+	pi, err := readPackageIndex(strings.NewReader(`Package: a
+Version: 1.0
+Conflicts: virt
+Filename: a_1.0_all.ipk
+
+Package: b
+Version: 1.0
+Provides: other | virt
+Filename: b_1.0_all.ipk
+
+Package: c
+Version: 1.0
+Provides: other, virt
+Filename: c_1.0_all.ipk
+
+Package: d
+Version: 1.0
+Provides: other
+Filename: d_1.0_all.ipk
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := pi.Entries["a_1.0_all.ipk"]
+	for name, expected := range map[string]bool{"b": true, "c": true, "d": false} {
+		other := pi.Entries[name+"_1.0_all.ipk"]
+		if conflicts(a, other) != expected || conflicts(other, a) != expected {
+			t.Errorf("a and %s: expected conflict %v", name, expected)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2016, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// gcPolicy describes which packages survive a garbage collection (-gc):
+// per Package+Architecture (see condenseKey()) the 'keep' newest
+// versions and all versions younger than 'maxAge' are kept, the rest is
+// moved to 'trash' (or deleted if 'trash' is empty).
+type gcPolicy struct {
+	keep   int
+	maxAge time.Duration
+	trash  string
+	dryRun bool
+}
+
+func (policy *gcPolicy) String() string {
+	var s = fmt.Sprintf("keep %d newest versions", policy.keep)
+	if policy.maxAge > 0 {
+		s += fmt.Sprintf(" and versions younger than %s", policy.maxAge)
+	}
+	if policy.trash != "" {
+		s += fmt.Sprintf(", move the rest to %q", policy.trash)
+	} else {
+		s += ", delete the rest"
+	}
+	if policy.dryRun {
+		s += " (dry-run)"
+	}
+	return s
+}
+
+// gcTree runs the garbage collection on all directories below 'root'
+// and rescans the directories which lost packages. returns the number
+// of removed packages (or the ones which would be removed in a dry-run).
+func gcTree(root, cache string, policy *gcPolicy, opts *scanOptions) int {
+
+	var nremoved int
+
+	log.Printf("gc: %s", policy)
+
+	// -root, -cache and -gc-trash might be given relative or absolute,
+	// compare them absolute
+	var trash = policy.trash
+	for _, name := range []*string{&root, &cache, &trash} {
+		if *name == "" {
+			continue
+		}
+		abs, err := filepath.Abs(*name)
+		if err != nil {
+			log.Printf("error: gc: %v", err)
+			return 0
+		}
+		*name = abs
+	}
+
+	filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if fi == nil || !fi.IsDir() {
+			return nil
+		}
+
+		// skip cache-directory, directories of running imports and the trash
+		if isSubPath(path, cache) || isStagingName(fi.Name()) ||
+			(trash != "" && isSubPath(path, trash)) {
+			return filepath.SkipDir
+		}
+
+		n, err := gcDir(root, cache, path, policy, opts)
+		if err != nil {
+			log.Printf("error: gc %q: %v", path, err)
+		}
+		nremoved += n
+
+		if n > 0 && !policy.dryRun {
+			if err = scanDir(root, cache, path, opts); err != nil {
+				log.Printf("error: %v", err)
+			}
+		}
+		return nil
+	})
+
+	if policy.dryRun {
+		log.Printf("gc: done, %d packages would be removed", nremoved)
+	} else {
+		log.Printf("gc: done, %d packages removed", nremoved)
+	}
+	return nremoved
+}
+
+// isSubPath returns true if 'path' is 'dir' or below it. both have
+// to be clean.
+func isSubPath(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, strings.TrimSuffix(dir, string(filepath.Separator))+string(filepath.Separator))
+}
+
+// gcDir applies 'policy' to the packages in 'path'
+func gcDir(root, cache, path string, policy *gcPolicy, opts *scanOptions) (int, error) {
+
+	var (
+		now          = time.Now()
+		relPath, _   = filepath.Rel(root, path)
+		cachePath, _ = filepath.Abs(filepath.Join(cache, relPath))
+		versions     = make(map[string][]*ipkArchive)
+		nremoved     int
+	)
+
+	opts = opts.forDir(relPath)
+	var scanner = packageScanner{
+		cache:    cachePath,
+		doMD5:    opts.doMD5,
+		doSHA1:   opts.doSHA1,
+		doSHA256: opts.doSHA256,
+	}
+
+	if err := scanner.scan(path, opts.nworkers); err != nil {
+		return 0, err
+	}
+
+	var keys []string
+	for _, pkg := range scanner.packages.Entries {
+		key := condenseKey(pkg)
+		if _, exists := versions[key]; !exists {
+			keys = append(keys, key)
+		}
+		versions[key] = append(versions[key], pkg)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		var pkgs = versions[key]
+
+		// newest first
+		sort.Slice(pkgs, func(i, j int) bool {
+			if cmp := compareVersion(pkgs[i].Header["Version"], pkgs[j].Header["Version"]); cmp != 0 {
+				return cmp > 0
+			}
+			return pkgs[i].Name > pkgs[j].Name
+		})
+
+		for i, pkg := range pkgs {
+			if i < policy.keep || now.Sub(pkg.FileInfo.ModTime()) < policy.maxAge {
+				continue
+			}
+			nremoved++
+
+			if policy.dryRun {
+				log.Printf("gc: would remove %s (superseded by %s)",
+					pkg.ScanLocation, pkgs[0].Header["Version"])
+				continue
+			}
+
+			if err := policy.remove(pkg, relPath); err != nil {
+				return nremoved - 1, err
+			}
+			os.Remove(genCachedRecordName(pkg.Name, cachePath))
+			log.Printf("gc: removed %s (superseded by %s)",
+				pkg.ScanLocation, pkgs[0].Header["Version"])
+		}
+	}
+
+	return nremoved, nil
+}
+
+// remove moves 'pkg' into the trash or deletes it. 'relPath' is the
+// directory of 'pkg' relative to -root, it is kept within the trash.
+func (policy *gcPolicy) remove(pkg *ipkArchive, relPath string) error {
+
+	if policy.trash == "" {
+		return os.Remove(pkg.ScanLocation)
+	}
+
+	var trashDir = filepath.Join(policy.trash, relPath)
+	if err := os.MkdirAll(trashDir, 0755); err != nil {
+		return err
+	}
+	return os.Rename(pkg.ScanLocation, filepath.Join(trashDir, pkg.Name))
+}
+
+// gcPeriodically runs gcTree every 'interval'
+func gcPeriodically(root, cache string, policy *gcPolicy, opts *scanOptions, interval time.Duration) {
+	for range time.Tick(interval) {
+		gcTree(root, cache, policy, opts)
+	}
+}
@@ -0,0 +1,144 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2016, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// mockVersions creates "foo_<version>_<arch>.ipk" in 'dir' for each of
+// 'versions', aged by the given duration
+func mockVersions(t *testing.T, dir, arch string, versions map[string]time.Duration) {
+
+	var gz = func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for version, age := range versions {
+		var (
+			control  = fmt.Sprintf("Package: foo\nVersion: %s\nArchitecture: %s\n", version, arch)
+			fileName = filepath.Join(dir, fmt.Sprintf("foo_%s_%s.ipk", version, arch))
+			mtime    = time.Now().Add(-age)
+		)
+		if err := ioutil.WriteFile(fileName, mockIpkControl(t, "control.tar.gz", gz, control), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(fileName, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// listDir returns the names of the packages in 'dir'
+func listDir(dir string) []string {
+	var names []string
+	entries, _ := ioutil.ReadDir(dir)
+	for _, entry := range entries {
+		if isPackageName(entry.Name()) {
+			names = append(names, entry.Name())
+		}
+	}
+	return names
+}
+
+func TestGCDir(t *testing.T) {
+
+	tmp, err := ioutil.TempDir("", "kellner-gc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		root  = filepath.Join(tmp, "root")
+		cache = filepath.Join(tmp, "cache")
+		trash = filepath.Join(tmp, "trash")
+		day   = 24 * time.Hour
+		opts  = &scanOptions{nworkers: 1, gzipper: gzGolang}
+	)
+	mockVersions(t, filepath.Join(root, "stable"), "all",
+		map[string]time.Duration{"1.0": 3 * day, "2.0": 2 * day, "3.0": time.Minute, "4.0": time.Minute})
+	mockVersions(t, filepath.Join(root, "stable"), "armv7", map[string]time.Duration{"1.0": 3 * day})
+
+	// the newest and the young versions are kept, per architecture
+	policy := &gcPolicy{keep: 1, maxAge: day, trash: trash, dryRun: true}
+	if n, err := gcDir(root, cache, filepath.Join(root, "stable"), policy, opts); err != nil || n != 2 {
+		t.Fatalf("dry-run: expected 2 packages to be removed, got %d (%v)", n, err)
+	}
+	if names := listDir(filepath.Join(root, "stable")); len(names) != 5 {
+		t.Fatalf("dry-run: expected all packages to be kept, got %v", names)
+	}
+
+	policy.dryRun = false
+	if n, err := gcDir(root, cache, filepath.Join(root, "stable"), policy, opts); err != nil || n != 2 {
+		t.Fatalf("expected 2 packages to be removed, got %d (%v)", n, err)
+	}
+	expected := []string{"foo_1.0_armv7.ipk", "foo_3.0_all.ipk", "foo_4.0_all.ipk"}
+	if names := listDir(filepath.Join(root, "stable")); fmt.Sprint(names) != fmt.Sprint(expected) {
+		t.Errorf("expected %v to be kept, got %v", expected, names)
+	}
+	expected = []string{"foo_1.0_all.ipk", "foo_2.0_all.ipk"}
+	if names := listDir(filepath.Join(trash, "stable")); fmt.Sprint(names) != fmt.Sprint(expected) {
+		t.Errorf("expected %v in the trash, got %v", expected, names)
+	}
+
+	// without a trash the packages are deleted
+	policy = &gcPolicy{keep: 1}
+	if n, err := gcDir(root, cache, filepath.Join(root, "stable"), policy, opts); err != nil || n != 1 {
+		t.Fatalf("expected 1 package to be removed, got %d (%v)", n, err)
+	}
+	expected = []string{"foo_1.0_armv7.ipk", "foo_4.0_all.ipk"}
+	if names := listDir(filepath.Join(root, "stable")); fmt.Sprint(names) != fmt.Sprint(expected) {
+		t.Errorf("expected %v to be kept, got %v", expected, names)
+	}
+}
+
+// the trash and the cache below a relative -root are left alone,
+// whether given relative or absolute
+func TestGCTreeSkipsTrash(t *testing.T) {
+
+	tmp, err := ioutil.TempDir("", "kellner-gc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	cwd, _ := os.Getwd()
+	if err = os.Chdir(tmp); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd)
+
+	var (
+		day  = 24 * time.Hour
+		old  = map[string]time.Duration{"1.0": 3 * day, "2.0": 2 * day}
+		opts = &scanOptions{nworkers: 1, gzipper: gzGolang}
+	)
+	mockVersions(t, "root", "all", map[string]time.Duration{"3.0": day})
+	mockVersions(t, filepath.Join("root", "trash"), "all", old)
+	mockVersions(t, filepath.Join("root", "cache"), "all", old)
+
+	// -gc-trash is absolute, see main()
+	policy := &gcPolicy{keep: 1, trash: filepath.Join(tmp, "root", "trash")}
+	if n := gcTree("root", filepath.Join("root", "cache"), policy, opts); n != 0 {
+		t.Errorf("expected no packages to be removed, got %d", n)
+	}
+	for _, dir := range []string{"trash", "cache"} {
+		if names := listDir(filepath.Join("root", dir)); len(names) != 2 {
+			t.Errorf("%s: expected the packages to be left alone, got %v", dir, names)
+		}
+	}
+}
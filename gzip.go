@@ -39,8 +39,7 @@ func gzGolang(w io.Writer, r io.Reader) error {
 	if _, err := io.Copy(gz, r); err != nil {
 		return err
 	}
-	gz.Flush()
-	return nil
+	return gz.Close()
 }
 
 // gzGzipPipe uses a pipe to 'gzip' (the executable) to create
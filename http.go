@@ -14,6 +14,23 @@ import (
 	"path/filepath"
 )
 
+// indexNames lists the files generated by scanRoot for each directory.
+// they live in the cache-directory and are served from there.
+var indexNames = []string{
+	"Packages", "Packages.gz", "Packages.stamps", "Packages.sig",
+	"Release", "Release.gpg", "InRelease",
+	_CheckReportName,
+}
+
+func isIndexName(name string) bool {
+	for i := range indexNames {
+		if name == indexNames[i] {
+			return true
+		}
+	}
+	return false
+}
+
 func makeIndexHandler(root, cache string) http.Handler {
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -23,8 +40,12 @@ func makeIndexHandler(root, cache string) http.Handler {
 			baseName = filepath.Base(path)
 		)
 
-		switch baseName {
-		case "Packages", "Packages.gz", "Packages.stamps":
+		if isExportName(baseName) {
+			exportTar(w, r, root, cache, nil)
+			return
+		}
+
+		if isIndexName(baseName) {
 			var cachedPath = filepath.Join(cache, r.URL.Path)
 			http.ServeFile(w, r, cachedPath)
 			return
@@ -0,0 +1,114 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2016, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"archive/tar"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// a GET on "/some/feed/.export.tar" (or .export.tar.gz, .export.tar.xz,
+// .export.tar.zst) streams all packages below "/some/feed" together
+// with their index files as tar-archive.
+const _ExportName = ".export.tar"
+
+// exportSuffixes lists the compressions an export is offered in
+var exportSuffixes = []string{"", ".gz", ".xz", ".zst"}
+
+func isExportName(name string) bool {
+	for _, suffix := range exportSuffixes {
+		if name == _ExportName+suffix {
+			return true
+		}
+	}
+	return false
+}
+
+// exportTar streams the export requested by 'r'. the directories
+// in 'hidden' ("/stable/armv7", see clientIDMuxer) are left out.
+func exportTar(w http.ResponseWriter, r *http.Request, root, cache string, hidden map[string]bool) {
+
+	var (
+		reqPath = path.Clean("/" + r.URL.Path)
+		name    = path.Base(reqPath)
+		top     = filepath.Join(root, path.Dir(reqPath))
+	)
+
+	if fi, err := os.Stat(top); err != nil || !fi.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	var contentType = "application/x-tar"
+	if ext := path.Ext(name); ext != ".tar" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+
+	compressed, err := compressWriter(name, w)
+	if err != nil {
+		writeError(http.StatusNotFound, w, r)
+		return
+	}
+
+	tw := tar.NewWriter(compressed)
+	if err = exportTreeTo(tw, root, cache, top, hidden); err != nil {
+		// the header is already sent, all we can do is to log
+		// and to abort the stream
+		log.Printf("error: exporting %q: %v", top, err)
+		return
+	}
+	tw.Close()
+	compressed.Close()
+}
+
+// exportTreeTo writes all packages below 'top' and the index files
+// for each directory to 'tw'. the names in the archive are relative
+// to 'top'. the directories in 'hidden' are skipped.
+func exportTreeTo(tw *tar.Writer, root, cache, top string, hidden map[string]bool) error {
+
+	return filepath.Walk(top, func(fileName string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if fi.IsDir() {
+			if isSubPath(fileName, cache) || isStagingName(fi.Name()) {
+				return filepath.SkipDir
+			}
+			var (
+				relRoot, _ = filepath.Rel(root, fileName)
+				relTop, _  = filepath.Rel(top, fileName)
+			)
+			if hidden[path.Join("/", filepath.ToSlash(relRoot))] {
+				return filepath.SkipDir
+			}
+			for _, name := range indexNames {
+				var cachedName = filepath.Join(cache, relRoot, name)
+				if _, err := os.Stat(cachedName); err != nil {
+					continue
+				}
+				if err := addFileToTar(tw, filepath.Join(relTop, name), cachedName); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		if !isPackageName(fi.Name()) {
+			return nil
+		}
+		var relTop, _ = filepath.Rel(top, fileName)
+		return addFileToTar(tw, relTop, fileName)
+	})
+}
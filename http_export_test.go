@@ -0,0 +1,183 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2016, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// exportNames serves 'r' via 'handler' and returns the status,
+// the content type and the sorted names in the (decompressed) archive
+func exportNames(t *testing.T, handler http.Handler, r *http.Request) (int, string, []string) {
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		return w.Code, "", nil
+	}
+
+	reader, err := decompressReader(r.URL.Path, w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	raw, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := tarNames(t, raw)
+	sort.Strings(names)
+	return w.Code, w.Header().Get("Content-Type"), names
+}
+
+func TestExportTar(t *testing.T) {
+
+	tmp, err := ioutil.TempDir("", "kellner-export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	// the cache is below the root, like in the default setup of some
+	// installations
+	var (
+		root  = filepath.Join(tmp, "root")
+		cache = filepath.Join(root, "cache")
+		opts  = &scanOptions{nworkers: 1, gzipper: gzGolang}
+		young = map[string]time.Duration{"1.0": 0}
+	)
+	mockVersions(t, filepath.Join(root, "stable"), "all", young)
+	mockVersions(t, filepath.Join(root, "stable", "armv7"), "armv7", young)
+	mockVersions(t, filepath.Join(root, "stable", _StagingPrefix+"1"), "armv7", young)
+	mockVersions(t, cache+"2", "all", young)
+	ioutil.WriteFile(filepath.Join(root, "stable", "README"), []byte("not a package"), 0644)
+	for _, dir := range []string{root, filepath.Join(root, "stable"), filepath.Join(root, "stable", "armv7"), cache + "2"} {
+		if err = scanDir(root, cache, dir, opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var (
+		handler = makeIndexHandler(root, cache)
+		index   = []string{"Packages", "Packages.gz", "Packages.stamps", "Release"}
+		stable  []string
+	)
+	for _, name := range index {
+		stable = append(stable, name, "armv7/"+name)
+	}
+	stable = append(stable, "armv7/foo_1.0_armv7.ipk", "foo_1.0_all.ipk")
+	sort.Strings(stable)
+
+	samples := []struct {
+		reqPath     string
+		code        int
+		contentType string
+		names       []string
+	}{
+		{"/stable/.export.tar", http.StatusOK, "application/x-tar", stable},
+		{"/stable/.export.tar.gz", http.StatusOK, "application/octet-stream", stable},
+		{"/stable/.export.tar.xz", http.StatusOK, "application/octet-stream", stable},
+		{"/stable/.export.tar.zst", http.StatusOK, "application/octet-stream", stable},
+		{"/stable/.export.tar.bz2", http.StatusNotFound, "", nil},
+		{"/stable/.export.tar.lz4", http.StatusNotFound, "", nil},
+		{"/stable/.export.tar.foo", http.StatusNotFound, "", nil},
+		{"/stable/.export.tarx", http.StatusNotFound, "", nil},
+		{"/stable/armv7/.export.tar", http.StatusOK, "application/x-tar",
+			[]string{"Packages", "Packages.gz", "Packages.stamps", "Release", "foo_1.0_armv7.ipk"}},
+		{"/missing/.export.tar", http.StatusNotFound, "", nil},
+	}
+
+	for _, sample := range samples {
+		code, contentType, names := exportNames(t, handler, httptest.NewRequest("GET", sample.reqPath, nil))
+		if code != sample.code || contentType != sample.contentType || !reflect.DeepEqual(names, sample.names) {
+			t.Errorf("%s: expected %d %q %v, got %d %q %v", sample.reqPath,
+				sample.code, sample.contentType, sample.names, code, contentType, names)
+		}
+	}
+
+	// the export of the root neither contains the cache nor the staging
+	// directories, but the feed "cache2"
+	_, _, names := exportNames(t, handler, httptest.NewRequest("GET", "/.export.tar", nil))
+	var ncache2 int
+	for _, name := range names {
+		if strings.HasPrefix(name, "cache/") || strings.Contains(name, _StagingPrefix) {
+			t.Errorf("/.export.tar: unexpected %q", name)
+		}
+		if strings.HasPrefix(name, "cache2/") {
+			ncache2++
+		}
+	}
+	if expected := len(stable) + 2*len(index) + 1; len(names) != expected || ncache2 != len(index)+1 {
+		t.Errorf("/.export.tar: expected %d entries, got %v", expected, names)
+	}
+}
+
+// the export of a mapped feed leaves out the sub-feeds the client sees
+// differently, see TestMuxerDeny as well
+func TestExportTarMapped(t *testing.T) {
+
+	root, cache, cleanup := mockFeeds(t, map[string]string{
+		"stable":       "all",
+		"stable/armv7": "mips",
+		"ci/armv7":     "armv7",
+	})
+	defer cleanup()
+
+	tokens := filepath.Join(root, "..", "tokens")
+	if err := ioutil.WriteFile(tokens, []byte("ci O=SolSys,OU=Build,CN=ci\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	auth := &clientAuth{}
+	if err := auth.Load(tokens, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	muxer := &clientIDMuxer{Root: root, Cache: cache, Muxer: http.NewServeMux(), Auth: auth}
+	muxer.Muxer.Handle("/", makeIndexHandler(root, cache))
+	muxer.SetMapping(&fileMapping{Clients: []idMapRule{
+		{ID: "O=SolSys", Feeds: map[string]string{"stable": "stable", "stable/armv7": "ci/armv7"}},
+	}})
+
+	request := func(reqPath string) *http.Request {
+		r := httptest.NewRequest("GET", reqPath, nil)
+		r.TLS = &tls.ConnectionState{}
+		r.Header.Set("Authorization", "Bearer ci")
+		return r
+	}
+
+	// "stable/armv7" is served from "ci/armv7", the export of "stable"
+	// must not contain the packages of the real "stable/armv7"
+	_, _, names := exportNames(t, muxer, request("/stable/.export.tar"))
+	expected := []string{"Packages", "Packages.gz", "Packages.stamps", "Release", "foo_1.0_all.ipk"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("/stable/.export.tar: expected %v, got %v", expected, names)
+	}
+
+	_, _, names = exportNames(t, muxer, request("/stable/armv7/.export.tar.gz"))
+	expected = []string{"Packages", "Packages.gz", "Packages.stamps", "Release", "foo_1.0_armv7.ipk"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("/stable/armv7/.export.tar.gz: expected %v, got %v", expected, names)
+	}
+
+	w := httptest.NewRecorder()
+	muxer.ServeHTTP(w, request("/ci/.export.tar"))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("/ci/.export.tar: expected %d for an unmapped feed, got %d", http.StatusNotFound, w.Code)
+	}
+}
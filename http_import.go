@@ -0,0 +1,240 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2016, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// a tar-archive uploaded to "/some/feed/.import.tar" (or .import.tar.gz,
+// .import.tar.xz ...) replaces the directory "/some/feed" as a whole.
+const (
+	_ImportName    = ".import.tar"
+	_StagingPrefix = ".kellner-staging-"
+)
+
+func isImportName(name string) bool {
+	return name == _ImportName || strings.HasPrefix(name, _ImportName+".")
+}
+
+// directories of running imports are hidden from scanning and watching
+func isStagingName(name string) bool {
+	return strings.HasPrefix(name, _StagingPrefix)
+}
+
+// importTar unpacks the tar-archive in the body of 'r' into a staging
+// directory next to the target directory. only if all packages in the
+// archive are valid the staging directory replaces the target directory.
+func (uh *uploadHandler) importTar(w http.ResponseWriter, r *http.Request, clientID, reqPath string) {
+
+	var (
+		name   = path.Base(reqPath)
+		relDir = path.Dir(reqPath) // reqPath is clean, no ".." left
+		target = filepath.Join(uh.Root, relDir)
+		parent = filepath.Dir(target)
+	)
+
+	if relDir == "/" {
+		log.Printf("error: import by %q: can't replace the root directory", clientID)
+		writeError(http.StatusBadRequest, w, r)
+		return
+	}
+
+	// the cache might be below -root
+	var absTarget, _ = filepath.Abs(target)
+	if absCache, _ := filepath.Abs(uh.Cache); isSubPath(absTarget, absCache) || isSubPath(absCache, absTarget) {
+		log.Printf("error: import by %q: can't replace %q, it is or contains the cache", clientID, target)
+		writeError(http.StatusBadRequest, w, r)
+		return
+	}
+
+	// no upload or other import may change 'target' meanwhile, the
+	// upload would be lost or the renames of swapDir() fail
+	unlock := lockForChange(uh.Root, target, true)
+	defer unlock()
+
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		log.Printf("error: creating %q: %v", parent, err)
+		writeError(http.StatusInternalServerError, w, r)
+		return
+	}
+
+	staging, err := ioutil.TempDir(parent, _StagingPrefix)
+	if err != nil {
+		log.Printf("error: creating staging directory in %q: %v", parent, err)
+		writeError(http.StatusInternalServerError, w, r)
+		return
+	}
+	defer os.RemoveAll(staging)
+
+	reader, err := decompressReader(name, r.Body)
+	if err != nil {
+		log.Printf("error: import of %q by %q: %v", reqPath, clientID, err)
+		writeError(http.StatusBadRequest, w, r)
+		return
+	}
+	defer reader.Close()
+
+	npackages, err := unpackTar(staging, reader)
+	if err != nil {
+		log.Printf("error: import of %q by %q: %v", reqPath, clientID, err)
+		writeError(http.StatusBadRequest, w, r)
+		return
+	}
+
+	if err = swapDir(staging, target); err != nil {
+		log.Printf("error: import of %q by %q: %v", reqPath, clientID, err)
+		writeError(http.StatusInternalServerError, w, r)
+		return
+	}
+
+	log.Printf("info: %q imported %d packages into %q", clientID, npackages, target)
+
+	scanTree(uh.Root, uh.Cache, target, uh.Opts)
+	pruneCache(uh.Root, uh.Cache, target)
+
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, "%d %q for %s: imported %d packages\n\n", http.StatusCreated,
+		http.StatusText(http.StatusCreated), path.Dir(reqPath), npackages)
+}
+
+// unpackTar extracts the directories and regular files from 'r' into
+// 'dir' and validates every package. it returns the number of packages.
+func unpackTar(dir string, r io.Reader) (int, error) {
+
+	var (
+		tarReader = tar.NewReader(r)
+		npackages int
+	)
+
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return npackages, fmt.Errorf("reading tar: %v", err)
+		}
+
+		var name = path.Clean("/" + header.Name)
+		if name == "/" {
+			continue
+		}
+		var fileName = filepath.Join(dir, name)
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err = os.MkdirAll(fileName, 0755); err != nil {
+				return npackages, err
+			}
+			continue
+		case tar.TypeReg:
+		default:
+			return npackages, fmt.Errorf("%q: unsupported type of entry %q", header.Name, header.Typeflag)
+		}
+
+		if err = os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+			return npackages, err
+		}
+		if err = writeTarEntry(fileName, tarReader); err != nil {
+			return npackages, err
+		}
+
+		if !isPackageName(name) {
+			continue
+		}
+		if err = validatePackageFile(fileName); err != nil {
+			return npackages, fmt.Errorf("%q: %v", header.Name, err)
+		}
+		npackages++
+	}
+
+	return npackages, nil
+}
+
+func writeTarEntry(fileName string, r io.Reader) error {
+	file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(file, r); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func validatePackageFile(fileName string) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return validatePackage(file)
+}
+
+// swapDir replaces 'target' by 'staging'. the old 'target' is moved
+// aside first, between both renames 'target' does not exist for a
+// moment but it is never half-filled.
+func swapDir(staging, target string) error {
+
+	if err := os.Chmod(staging, 0755); err != nil {
+		return err
+	}
+
+	var old string
+	if _, err := os.Stat(target); err == nil {
+		old = staging + ".old"
+		if err = os.Rename(target, old); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Rename(staging, target); err != nil {
+		if old == "" {
+			return err
+		}
+		if rerr := os.Rename(old, target); rerr != nil {
+			return fmt.Errorf("%v, restoring %q from %q failed: %v", err, target, old, rerr)
+		}
+		return err
+	}
+
+	if old != "" {
+		return os.RemoveAll(old)
+	}
+	return nil
+}
+
+// pruneCache removes the cached meta-data of directories below 'top'
+// which do not exist (anymore) in 'root'.
+func pruneCache(root, cache, top string) {
+
+	var relTop, _ = filepath.Rel(root, top)
+
+	filepath.Walk(filepath.Join(cache, relTop), func(cachePath string, fi os.FileInfo, err error) error {
+		if fi == nil || !fi.IsDir() {
+			return nil
+		}
+		var relPath, _ = filepath.Rel(cache, cachePath)
+		if _, err = os.Stat(filepath.Join(root, relPath)); os.IsNotExist(err) {
+			os.RemoveAll(cachePath)
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
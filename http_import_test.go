@@ -0,0 +1,205 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2016, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// mockTar creates a tar-archive of 'entries', the content of a
+// TypeReg entry is 'content'
+func mockTar(t *testing.T, content []byte, entries ...tar.Header) []byte {
+	var (
+		buf bytes.Buffer
+		tw  = tar.NewWriter(&buf)
+	)
+	for _, header := range entries {
+		if header.Mode == 0 {
+			header.Mode = 0644
+		}
+		if header.Typeflag == tar.TypeReg {
+			header.Size = int64(len(content))
+		}
+		if err := tw.WriteHeader(&header); err != nil {
+			t.Fatal(err)
+		}
+		if header.Typeflag == tar.TypeReg {
+			tw.Write(content)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestImportTar(t *testing.T) {
+
+	root, cache, cleanup := mockRoot(t)
+	defer cleanup()
+
+	// a root given with a trailing slash must not matter
+	var (
+		uh  = mockUploadHandler(t, root+string(filepath.Separator), cache)
+		gz  = func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }
+		ipk = mockIpk(t, "control.tar.gz", gz)
+		reg = func(name string) tar.Header { return tar.Header{Name: name, Typeflag: tar.TypeReg} }
+	)
+
+	samples := []struct {
+		reqPath string
+		archive []byte
+		code    int
+	}{
+		{"/.import.tar", mockTar(t, ipk, reg("bar_1.0-r0_all.ipk")), http.StatusBadRequest},
+		{"/stable/../.import.tar", mockTar(t, ipk, reg("bar_1.0-r0_all.ipk")), http.StatusBadRequest},
+		{"/stable/../../.import.tar", mockTar(t, ipk, reg("bar_1.0-r0_all.ipk")), http.StatusBadRequest},
+		{"/stable/.import.tar", mockTar(t, ipk, reg("bar_1.0-r0_all.ipk"),
+			tar.Header{Name: "evil", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"}), http.StatusBadRequest},
+		{"/stable/.import.tar", mockTar(t, ipk, reg("bar_1.0-r0_all.ipk"),
+			tar.Header{Name: "evil", Typeflag: tar.TypeLink, Linkname: "bar_1.0-r0_all.ipk"}), http.StatusBadRequest},
+		{"/stable/.import.tar", mockTar(t, []byte("no ipk"), reg("bar_1.0-r0_all.ipk")), http.StatusBadRequest},
+		{"/stable/.import.tar", mockTar(t, ipk, reg("../../bar_1.0-r0_all.ipk"),
+			tar.Header{Name: "armv7/", Typeflag: tar.TypeDir, Mode: 0755}, reg("armv7/bar_1.0-r0_all.ipk")), http.StatusCreated},
+	}
+
+	for i, sample := range samples {
+		w := httptest.NewRecorder()
+		uh.ServeHTTP(w, putRequest(sample.reqPath, "ci", sample.archive))
+		if w.Code != sample.code {
+			t.Errorf("sample %d: %s: expected %d, got %d", i, sample.reqPath, sample.code, w.Code)
+		}
+	}
+
+	// the root is untouched, ".." in the archive stays in the target
+	for _, name := range []string{"foo_1.0-r0_all.ipk", "stable/bar_1.0-r0_all.ipk", "stable/armv7/bar_1.0-r0_all.ipk"} {
+		if _, err := os.Stat(filepath.Join(root, name)); err != nil {
+			t.Errorf("expected %q: %v", name, err)
+		}
+	}
+	for _, name := range []string{"../bar_1.0-r0_all.ipk", "bar_1.0-r0_all.ipk", "stable/evil"} {
+		if _, err := os.Lstat(filepath.Join(root, name)); err == nil {
+			t.Errorf("unexpected %q", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(cache, "stable", "armv7", "Packages")); err != nil {
+		t.Errorf("expected the imported packages to be indexed: %v", err)
+	}
+
+	// no staging directories are left behind
+	matches, _ := filepath.Glob(filepath.Join(root, _StagingPrefix+"*"))
+	if len(matches) > 0 {
+		t.Errorf("unexpected staging directories %v", matches)
+	}
+}
+
+// imports and uploads into the same feed are serialized, none of them
+// fails and no staging directory is left behind
+func TestImportTarConcurrent(t *testing.T) {
+
+	root, cache, cleanup := mockRoot(t)
+	defer cleanup()
+
+	var (
+		uh      = mockUploadHandler(t, root, cache)
+		gz      = func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }
+		ipk     = mockIpk(t, "control.tar.gz", gz)
+		archive = mockTar(t, ipk, tar.Header{Name: "foo_1.0_all.ipk", Typeflag: tar.TypeReg})
+		wg      sync.WaitGroup
+		codes   = make(chan string, 20)
+	)
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			uh.ServeHTTP(w, putRequest("/stable/.import.tar", "ci", archive))
+			codes <- fmt.Sprintf("import: %d", w.Code)
+		}()
+		go func(i int) {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			uh.ServeHTTP(w, putRequest(fmt.Sprintf("/stable/bar_%d_all.ipk", i), "ci", ipk))
+			codes <- fmt.Sprintf("upload: %d", w.Code)
+		}(i)
+	}
+	wg.Wait()
+	close(codes)
+
+	for code := range codes {
+		if code != "import: 201" && code != "upload: 201" {
+			t.Errorf("expected 201, got %s", code)
+		}
+	}
+	entries, _ := ioutil.ReadDir(root)
+	for _, entry := range entries {
+		if isStagingName(entry.Name()) {
+			t.Errorf("expected no staging directories, got %q", entry.Name())
+		}
+	}
+}
+
+// the cache below -root is neither replaced nor contained by an import,
+// bodies beyond -upload-max-size are refused
+func TestImportTarRefused(t *testing.T) {
+
+	root, tokensDir, cleanup := mockRoot(t)
+	defer cleanup()
+
+	var (
+		gz      = func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }
+		ipk     = mockIpk(t, "control.tar.gz", gz)
+		archive = mockTar(t, ipk, tar.Header{Name: "foo_1.0_all.ipk", Typeflag: tar.TypeReg})
+	)
+
+	samples := []struct {
+		cache   string
+		maxSize int64
+		reqPath string
+		code    int
+	}{
+		{"cache", 0, "/cache/.import.tar", http.StatusBadRequest},
+		{"cache", 0, "/cache/stable/.import.tar", http.StatusBadRequest},
+		{"feeds/cache", 0, "/feeds/.import.tar", http.StatusBadRequest},
+		{"cache", int64(len(archive) - 1), "/stable/.import.tar", http.StatusRequestEntityTooLarge},
+		{"cache", int64(len(ipk) - 1), "/stable/foo_1.0_all.ipk", http.StatusRequestEntityTooLarge},
+		{"cache", int64(len(archive)), "/stable/.import.tar", http.StatusCreated},
+	}
+	for _, sample := range samples {
+		var (
+			cache = filepath.Join(root, filepath.FromSlash(sample.cache))
+			uh    = mockUploadHandler(t, root, tokensDir)
+			body  = archive
+			w     = httptest.NewRecorder()
+		)
+		uh.Cache, uh.MaxSize = cache, sample.maxSize
+		os.MkdirAll(cache, 0755)
+		if !isImportName(filepath.Base(sample.reqPath)) {
+			body = ipk
+		}
+		uh.ServeHTTP(w, putRequest(sample.reqPath, "ci", body))
+		if w.Code != sample.code {
+			t.Errorf("%s (-cache %s): expected %d, got %d", sample.reqPath, sample.cache, sample.code, w.Code)
+		}
+		if _, err := os.Stat(cache); err != nil {
+			t.Errorf("%s (-cache %s): expected the cache to stay, got %v", sample.reqPath, sample.cache, err)
+		}
+	}
+}
@@ -83,13 +83,16 @@ type renderCtx struct {
 }
 
 func renderIndex(w http.ResponseWriter, r *http.Request, root, cache string) {
+	renderIndexAs(w, r, root, cache, r.URL.Path, r.URL.Path, nil)
+}
 
-	var reqPath = filepath.Join(root, r.URL.Path)
-	var ctx = renderCtx{
-		Title:   r.URL.Path + " - kellner",
-		Version: versionString,
-		Date:    time.Now()}
+// renderIndexAs renders the directory 'dirPath' (below 'root') as if it
+// were 'urlPath': a client behind the clientIDMuxer requests 'urlPath'
+// but gets the listing of the mapped 'dirPath'. the links are based
+// upon 'urlPath'.
+func renderIndexAs(w http.ResponseWriter, r *http.Request, root, cache, dirPath, urlPath string, hidden map[string]bool) {
 
+	var reqPath = filepath.Join(root, dirPath)
 	var dir, err = os.Open(reqPath)
 	if err != nil {
 		http.NotFound(w, r)
@@ -101,46 +104,80 @@ func renderIndex(w http.ResponseWriter, r *http.Request, root, cache string) {
 
 	entries, err = dir.Readdir(-1)
 
-	if entry, err = os.Stat(filepath.Join(cache, r.URL.Path, "Packages")); err == nil {
-		entries = append(entries, entry)
-	}
-	if entry, err = os.Stat(filepath.Join(cache, r.URL.Path, "Packages.gz")); err == nil {
-		entries = append(entries, entry)
-	}
-	if entry, err = os.Stat(filepath.Join(cache, r.URL.Path, "Packages.stamps")); err == nil {
-		entries = append(entries, entry)
+	for _, name := range indexNames {
+		if entry, err = os.Stat(filepath.Join(cache, dirPath, name)); err == nil {
+			entries = append(entries, entry)
+		}
 	}
 
-	ctx.Entries = make([]dirEntry, len(entries)+1)
-
-	var i int
-	for i, entry = range entries {
-		ctx.Entries[i] = dirEntry{
+	var dirEntries = make([]dirEntry, 0, len(entries)+1)
+	for _, entry = range entries {
+		// neither the cache nor the uploads in progress are
+		// part of the listing
+		if isStagingName(entry.Name()) || filepath.Join(reqPath, entry.Name()) == filepath.Clean(cache) {
+			continue
+		}
+		// nor the sub-feeds denied to a mapped client
+		if hidden[path.Join("/", dirPath, entry.Name())] {
+			continue
+		}
+		dirEntries = append(dirEntries, dirEntry{
 			Name:    entry.Name(),
-			Href:    path.Join(r.URL.Path, entry.Name()),
+			Href:    path.Join(urlPath, entry.Name()),
 			ModTime: entry.ModTime(),
 			Size:    int64(entry.Size()),
-		}
+		})
 		/* TODO: re-enable
 		var raw, _ = ioutil.ReadFile(filepath.Join(cache, entry.Name()))
 		ctx.Entries[i].RawDescr = string(raw)
 		*/
-
-		ctx.SumFileSize += entry.Size()
 	}
 
-	if reqPath == root {
-		ctx.Entries = ctx.Entries[:len(ctx.Entries)-1]
-	} else {
-		ctx.Entries[len(ctx.Entries)-1] = dirEntry{
+	if path.Clean("/"+urlPath) != "/" {
+		dirEntries = append(dirEntries, dirEntry{
 			Name:    "..",
-			Href:    path.Join(r.URL.Path, ".."),
-			ModTime: ctx.Date,
+			Href:    path.Join(urlPath, ".."),
+			ModTime: time.Now(),
+		})
+	}
+
+	renderEntries(w, r, urlPath, dirEntries)
+}
+
+// renderFeeds renders the list of 'feeds' (feed => directory below
+// 'root') a mapped client can see. see clientIDMuxer
+func renderFeeds(w http.ResponseWriter, r *http.Request, root string, feeds map[string]string) {
+
+	var entries = make([]dirEntry, 0, len(feeds))
+	for feed, dir := range feeds {
+		fi, err := os.Stat(filepath.Join(root, filepath.FromSlash(path.Clean("/"+dir))))
+		if err != nil || !fi.IsDir() {
+			continue
 		}
+		entries = append(entries, dirEntry{
+			Name:    feed,
+			Href:    path.Join("/", feed) + "/",
+			ModTime: fi.ModTime(),
+			Size:    fi.Size(),
+		})
+	}
+	renderEntries(w, r, "/", entries)
+}
+
+func renderEntries(w http.ResponseWriter, r *http.Request, title string, entries []dirEntry) {
+
+	var ctx = renderCtx{
+		Title:   title + " - kellner",
+		Entries: entries,
+		Version: versionString,
+		Date:    time.Now()}
+
+	for _, entry := range entries {
+		ctx.SumFileSize += entry.Size
 	}
 	sort.Sort(dirEntryByName(ctx.Entries))
 
-	if err = indexTemplate.Execute(w, ctx); err != nil {
-		log.Println("error: rendering %q: %v", r.URL.Path, err)
+	if err := indexTemplate.Execute(w, ctx); err != nil {
+		log.Printf("error: rendering %q: %v", r.URL.Path, err)
 	}
 }
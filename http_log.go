@@ -13,13 +13,26 @@ import (
 	"net/http"
 )
 
-const _ExtraLogKey = "kellner-log-data"
+const (
+	_ExtraLogKey    = "kellner-log-data"
+	_ClientIDLogKey = "kellner-log-client-id"
+)
+
+// logClientID records the client-id derived by a handler for the log,
+// deriving it again would cost another bcrypt comparison for each
+// (wrong) basic password
+func logClientID(r *http.Request, clientID string) {
+	r.Header.Set(_ClientIDLogKey, clientID)
+}
 
-// wraps 'orig_handler' to log incoming http-request
-func logRequests(next http.Handler) http.Handler {
+// wraps 'orig_handler' to log incoming http-request. the logged client-id
+// is the one recorded via logClientID(), 'clientID' derives it from the
+// client-cert otherwise.
+func logRequests(next http.Handler, clientID clientIDFunc) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
 		r.Header.Del(_ExtraLogKey)
+		r.Header.Del(_ClientIDLogKey)
 
 		statusLog := logStatusCode{ResponseWriter: w}
 		next.ServeHTTP(&statusLog, r)
@@ -27,13 +40,25 @@ func logRequests(next http.Handler) http.Handler {
 			statusLog.Code = 200
 		}
 
-		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
-			log.Println(r.RemoteAddr, r.Method, statusLog.Code, r.Host, r.RequestURI, r.Header)
+		loggedID := r.Header.Values(_ClientIDLogKey)
+		r.Header.Del(_ClientIDLogKey)
+		if len(loggedID) == 0 && r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			loggedID = []string{clientID.of(r.TLS.PeerCertificates[0])}
+		}
+
+		// tokens and passwords do not belong into the log
+		header := r.Header
+		if header.Get("Authorization") != "" {
+			header = header.Clone()
+			header.Set("Authorization", "[redacted]")
+		}
+
+		if len(loggedID) == 0 {
+			log.Println(r.RemoteAddr, r.Method, statusLog.Code, r.Host, r.RequestURI, header)
 			return
 		}
 
-		clientID := clientIDByName(&r.TLS.PeerCertificates[0].Subject)
-		log.Println(r.RemoteAddr, clientID, r.Method, statusLog.Code, r.Host, r.RequestURI, r.Header)
+		log.Println(r.RemoteAddr, loggedID[0], r.Method, statusLog.Code, r.Host, r.RequestURI, header)
 	})
 }
 
@@ -0,0 +1,63 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2016, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// the logged client-id is the one recorded by the handler, logRequests
+// does not check the credentials again
+func TestLogRequests(t *testing.T) {
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	recording := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logClientID(r, "O=SolSys,CN=ci")
+	})
+	silent := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	samples := []struct {
+		handler  http.Handler
+		spoofed  string
+		expected string
+	}{
+		{recording, "", " O=SolSys,CN=ci GET 200 "},
+		{silent, "", " GET 200 "},
+		{silent, "O=SolSys,CN=admin", " GET 200 "},
+	}
+
+	for i, sample := range samples {
+		buf.Reset()
+		r := httptest.NewRequest("GET", "/stable/Packages", nil)
+		r.TLS = &tls.ConnectionState{}
+		r.Header.Set("Authorization", "Bearer secret")
+		if sample.spoofed != "" {
+			r.Header.Set(_ClientIDLogKey, sample.spoofed)
+		}
+		logRequests(sample.handler, nil).ServeHTTP(httptest.NewRecorder(), r)
+
+		line := buf.String()
+		if !strings.Contains(line, r.RemoteAddr+sample.expected) {
+			t.Errorf("sample %d: expected %q in %q", i, sample.expected, line)
+		}
+		if strings.Contains(line, "secret") || strings.Contains(line, "admin") {
+			t.Errorf("sample %d: expected no credentials or spoofed client-id in %q", i, line)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2016, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// serveOpkgConf delivers an opkg.conf with all feeds 'clientID' can see
+func (muxer *clientIDMuxer) serveOpkgConf(w http.ResponseWriter, r *http.Request, clientID string) {
+
+	feeds, err := muxer.mapping().Rules(clientID)
+	if err != nil {
+		log.Printf("warning: collecting the feeds for %q yields %v", clientID, err)
+		writeError(http.StatusInternalServerError, w, r)
+		return
+	}
+
+	var scheme = "http://"
+	if r.TLS != nil {
+		scheme = "https://"
+	}
+
+	var buf = bytes.NewBuffer(nil)
+	opkgConfTo(buf, scheme+requestHost(r), clientID, muxer.Root, muxer.Cache, feeds)
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.Copy(w, buf)
+}
+
+// requestHost returns the "Host" of 'r' if it looks like "host[:port]",
+// otherwise the local address the request came in on. the host ends up
+// in the delivered opkg.conf.
+func requestHost(r *http.Request) string {
+	var host = r.Host
+	if name, port, err := net.SplitHostPort(r.Host); err == nil {
+		host = name
+		if !validPort(port) {
+			host = ""
+		}
+	}
+	if validHostName(host) {
+		return r.Host
+	}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		return addr.String()
+	}
+	return "localhost"
+}
+
+func validHostName(host string) bool {
+	if ip := net.ParseIP(strings.Trim(host, "[]")); ip != nil {
+		return true
+	}
+	if host == "" || len(host) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(host, ".") {
+		if label == "" || len(label) > 63 || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func validPort(port string) bool {
+	n, err := strconv.Atoi(port)
+	return err == nil && n > 0 && n < 65536
+}
+
+// opkgConfTo writes an opkg.conf to 'w': a "src/gz" line for each
+// directory with packages below the given 'feeds' (see idMapping.Rules(),
+// denied feeds are skipped) and an "arch" line for each architecture
+// found in these directories. the directories and their architectures
+// are taken from the last scan of each directory (see indexedDirs()),
+// nothing is read from 'cache'. a directory below a feed which is a feed
+// of its own (eg. "stable/armv7" below "stable") is taken from its own
+// mapping only, or not at all if denied. the source names must be unique
+// for opkg, the first feed wins.
+func opkgConfTo(w io.Writer, baseURL, clientID, root, cache string, feeds map[string]string) {
+
+	var (
+		names    = make([]string, 0, len(feeds))
+		archs    = make(map[string]bool)
+		srcNames = make(map[string]string) // source name => path
+		srcs     []string
+	)
+	for feed := range feeds {
+		names = append(names, feed)
+	}
+	sort.Strings(names)
+
+	root, _ = filepath.Abs(root)
+	cache, _ = filepath.Abs(cache)
+
+	for _, feed := range names {
+
+		if feeds[feed] == _DenyMapping {
+			continue
+		}
+		var dir = filepath.Join(root, filepath.FromSlash(path.Clean("/"+feeds[feed])))
+		if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+			continue
+		}
+
+		// the feed itself and all the directories below it which
+		// contain packages, in the order of a filepath.Walk()
+		var indexed = indexedDirs(dir)
+		var subPaths = make([][]string, 0, len(indexed))
+		for name := range indexed {
+			if isSubPath(name, cache) {
+				continue
+			}
+			var subPath, _ = filepath.Rel(dir, name)
+			subPaths = append(subPaths, strings.Split(filepath.ToSlash(subPath), "/"))
+		}
+		sort.Slice(subPaths, func(i, j int) bool {
+			a, b := subPaths[i], subPaths[j]
+			for k := 0; k < len(a) && k < len(b); k++ {
+				if a[k] != b[k] {
+					return a[k] < b[k]
+				}
+			}
+			return len(a) < len(b)
+		})
+
+	nextDir:
+		for _, subPath := range subPaths {
+
+			var srcPath = feed
+			if subPath[0] != "." {
+				for i, elem := range subPath {
+					if isStagingName(elem) {
+						continue nextDir
+					}
+					if _, isFeed := feeds[feed+"/"+strings.Join(subPath[:i+1], "/")]; isFeed {
+						continue nextDir
+					}
+				}
+				srcPath = feed + "/" + strings.Join(subPath, "/")
+			}
+
+			var name = filepath.Join(dir, filepath.FromSlash(strings.Join(subPath, "/")))
+			if fi, err := os.Stat(name); err != nil || !fi.IsDir() {
+				continue
+			}
+
+			srcName := strings.Replace(srcPath, "/", "-", -1)
+			if other, exists := srcNames[srcName]; exists {
+				log.Printf("warning: opkg.conf for %q: %q and %q share the name %q, skipping %q",
+					clientID, other, srcPath, srcName, srcPath)
+				continue
+			}
+			srcNames[srcName] = srcPath
+
+			for _, arch := range indexed[name] {
+				archs[arch] = true
+			}
+			srcs = append(srcs, fmt.Sprintf("src/gz %s %s/%s", srcName, baseURL, srcPath))
+		}
+	}
+
+	fmt.Fprintf(w, "# opkg.conf for %q\n", clientID)
+	var archNames = make([]string, 0, len(archs))
+	for arch := range archs {
+		if arch != "" {
+			archNames = append(archNames, arch)
+		}
+	}
+	sort.Strings(archNames)
+	for _, arch := range archNames {
+		var priority = 10
+		if arch == "all" || arch == "noarch" || arch == "any" {
+			priority = 1
+		}
+		fmt.Fprintf(w, "arch %s %d\n", arch, priority)
+	}
+	for _, src := range srcs {
+		fmt.Fprintln(w, src)
+	}
+}
@@ -0,0 +1,158 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2016, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mockFeeds creates a -root with a package per directory of 'dirs'
+// (directory => architecture), scans it and returns root, cache and
+// a function to remove everything
+func mockFeeds(t *testing.T, dirs map[string]string) (string, string, func()) {
+
+	tmp, err := ioutil.TempDir("", "kellner-feeds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		root  = filepath.Join(tmp, "root")
+		cache = filepath.Join(tmp, "cache")
+		opts  = &scanOptions{nworkers: 1, gzipper: gzGolang}
+	)
+	for dir, arch := range dirs {
+		dir = filepath.Join(root, filepath.FromSlash(dir))
+		if arch == "" {
+			os.MkdirAll(dir, 0755)
+			continue
+		}
+		mockVersions(t, dir, arch, map[string]time.Duration{"1.0": 0})
+		if err = scanDir(root, cache, dir, opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root, cache, func() { os.RemoveAll(tmp) }
+}
+
+func TestOpkgConf(t *testing.T) {
+
+	root, cache, cleanup := mockFeeds(t, map[string]string{
+		"stable":       "all",
+		"stable/armv7": "mips",
+		"stable/x86":   "x86_64",
+		"ci/armv7":     "armv7",
+		"empty":        "",
+		"a-b":          "all",
+		"a/b":          "all",
+	})
+	defer cleanup()
+
+	samples := []struct {
+		feeds    map[string]string
+		expected string
+	}{
+		{map[string]string{"stable": "stable"}, `# opkg.conf for "O=SolSys"
+arch all 1
+arch mips 10
+arch x86_64 10
+src/gz stable http://kellner/stable
+src/gz stable-armv7 http://kellner/stable/armv7
+src/gz stable-x86 http://kellner/stable/x86
+`},
+		// "stable/armv7" is a feed of its own, not taken from "stable"
+		{map[string]string{"stable": "stable", "stable/armv7": "ci/armv7"}, `# opkg.conf for "O=SolSys"
+arch all 1
+arch armv7 10
+arch x86_64 10
+src/gz stable http://kellner/stable
+src/gz stable-x86 http://kellner/stable/x86
+src/gz stable-armv7 http://kellner/stable/armv7
+`},
+		// a denied sub-feed is left out
+		{map[string]string{"stable": "stable", "stable/armv7": "deny"}, `# opkg.conf for "O=SolSys"
+arch all 1
+arch x86_64 10
+src/gz stable http://kellner/stable
+src/gz stable-x86 http://kellner/stable/x86
+`},
+		// both become "a-b", the first one wins
+		{map[string]string{"a-b": "a-b", "a/b": "a/b"}, `# opkg.conf for "O=SolSys"
+arch all 1
+src/gz a-b http://kellner/a-b
+`},
+		{map[string]string{"missing": "missing", "empty": "empty"}, `# opkg.conf for "O=SolSys"
+`},
+	}
+
+	for i, sample := range samples {
+		var buf bytes.Buffer
+		opkgConfTo(&buf, "http://kellner", "O=SolSys", root, cache, sample.feeds)
+		if buf.String() != sample.expected {
+			t.Errorf("sample %d: expected\n%s\ngot\n%s", i, sample.expected, buf.String())
+		}
+	}
+
+	// the scanned state is used, not the Packages files in the cache.
+	// a removed directory is left out.
+	os.RemoveAll(cache)
+	os.RemoveAll(filepath.Join(root, "stable", "x86"))
+	var buf bytes.Buffer
+	opkgConfTo(&buf, "http://kellner", "O=SolSys", root, cache, map[string]string{"stable": "stable"})
+	expected := `# opkg.conf for "O=SolSys"
+arch all 1
+arch mips 10
+src/gz stable http://kellner/stable
+src/gz stable-armv7 http://kellner/stable/armv7
+`
+	if buf.String() != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, buf.String())
+	}
+
+	// a cache "a" inside the feed hides "a/b" but not its namesake "a-b"
+	buf.Reset()
+	opkgConfTo(&buf, "http://kellner", "O=SolSys", root, filepath.Join(root, "a"), map[string]string{"top": "."})
+	if !strings.Contains(buf.String(), "src/gz top-a-b http://kellner/top/a-b\n") ||
+		strings.Contains(buf.String(), "http://kellner/top/a/b") {
+		t.Errorf("expected top/a-b but not top/a/b in\n%s", buf.String())
+	}
+}
+
+func TestRequestHost(t *testing.T) {
+
+	var local = &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 443}
+	samples := []struct{ host, expected string }{
+		{"kellner.example.com", "kellner.example.com"},
+		{"kellner.example.com:8443", "kellner.example.com:8443"},
+		{"10.0.0.1:80", "10.0.0.1:80"},
+		{"[::1]:8080", "[::1]:8080"},
+		{"", "10.0.0.1:443"},
+		{"evil.com/x?", "10.0.0.1:443"},
+		{"user@evil.com", "10.0.0.1:443"},
+		{"kellner:99999", "10.0.0.1:443"},
+		{"-kellner", "10.0.0.1:443"},
+	}
+	for _, sample := range samples {
+		r := httptest.NewRequest("GET", "/opkg.conf", nil)
+		r = r.WithContext(context.WithValue(r.Context(), http.LocalAddrContextKey, net.Addr(local)))
+		r.Host = sample.host
+		if host := requestHost(r); host != sample.expected {
+			t.Errorf("requestHost(%q): expected %q, got %q", sample.host, sample.expected, host)
+		}
+	}
+}
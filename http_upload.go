@@ -0,0 +1,229 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2016, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// uploadHandler accepts packages (or tar-archives of packages, see
+// importTar) via PUT or POST, eg.
+//
+//	curl --cert ci.crt --key ci.key -T foo_1.0_all.ipk https://kellner/feed/foo_1.0_all.ipk
+//
+// the request path is the path of the package below root. only clients
+// presenting a verified certificate (or a token or basic credentials, see
+// clientAuth) whose client-id is listed in 'Clients' (or is below one of
+// the listed ids) are allowed to upload. all other requests are passed
+// to 'Next'.
+type uploadHandler struct {
+	Root    string
+	Cache   string
+	Opts    *scanOptions
+	Clients []string
+	MaxSize int64       // of a package or an archive in bytes, see -upload-max-size
+	Auth    *clientAuth // derives the client-id, see -client-id, -auth-tokens and -auth-htpasswd
+	Next    http.Handler
+}
+
+func (uh *uploadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "PUT" && r.Method != "POST" {
+		uh.Next.ServeHTTP(w, r)
+		return
+	}
+
+	// uploads require tls and either a verified client-cert or
+	// a token or basic credentials
+	clientID, method := uh.Auth.of(r)
+	if r.TLS == nil || method == authNone || (method == authCert && len(r.TLS.VerifiedChains) == 0) {
+		uh.Auth.challenge(w)
+		writeError(http.StatusUnauthorized, w, r)
+		return
+	}
+	logClientID(r, clientID)
+
+	if clientID == "" || !clientIDAllowed(clientID, uh.Clients) {
+		log.Printf("info: upload of %q denied for %q", r.URL.Path, clientID)
+		writeError(http.StatusForbidden, w, r)
+		return
+	}
+
+	if uh.MaxSize > 0 {
+		if r.ContentLength > uh.MaxSize {
+			log.Printf("info: upload of %q by %q exceeds -upload-max-size", r.URL.Path, clientID)
+			writeError(http.StatusRequestEntityTooLarge, w, r)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, uh.MaxSize)
+	}
+
+	var (
+		reqPath  = path.Clean("/" + r.URL.Path)
+		name     = path.Base(reqPath)
+		dirName  = filepath.Join(uh.Root, path.Dir(reqPath))
+		fileName = filepath.Join(dirName, name)
+	)
+
+	if isImportName(name) {
+		uh.importTar(w, r, clientID, reqPath)
+		return
+	}
+
+	if !isPackageName(name) {
+		writeError(http.StatusBadRequest, w, r)
+		return
+	}
+
+	// a cheap check to not receive the body in vain, storeUpload()
+	// refuses to overwrite existing packages anyway
+	if _, err := os.Stat(fileName); err == nil {
+		writeError(http.StatusConflict, w, r)
+		return
+	}
+
+	// an import must not replace the directory meanwhile, see importTar()
+	unlock := lockForChange(uh.Root, dirName, false)
+	if err := os.MkdirAll(dirName, 0755); err != nil {
+		unlock()
+		log.Printf("error: creating %q: %v", dirName, err)
+		writeError(http.StatusInternalServerError, w, r)
+		return
+	}
+	err := storeUpload(fileName, r.Body)
+	unlock()
+
+	if err != nil {
+		log.Printf("error: upload of %q by %q: %v", reqPath, clientID, err)
+		if _, bad := err.(badUploadError); bad {
+			writeError(http.StatusBadRequest, w, r)
+		} else if err == errUploadExists {
+			writeError(http.StatusConflict, w, r)
+		} else {
+			writeError(http.StatusInternalServerError, w, r)
+		}
+		return
+	}
+
+	log.Printf("info: %q uploaded %q", clientID, reqPath)
+
+	if err := scanDir(uh.Root, uh.Cache, dirName, uh.Opts); err != nil {
+		log.Printf("error: %v", err)
+		writeError(http.StatusInternalServerError, w, r)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, "%d %q for %s\n\n", http.StatusCreated, http.StatusText(http.StatusCreated), reqPath)
+}
+
+var errUploadExists = errors.New("package exists already")
+
+// badUploadError marks the errors caused by the uploaded data (and
+// not by the server)
+type badUploadError struct{ error }
+
+// storeUpload writes 'body' into a temporary file next to 'fileName',
+// checks if it is a valid package and then links it to 'fileName'.
+// linking fails if 'fileName' exists (eg. created by a concurrent
+// upload), existing packages are never overwritten. the temporary
+// name does not look like a package, scanners ignore it.
+func storeUpload(fileName string, body io.Reader) error {
+
+	tmp, err := ioutil.TempFile(filepath.Dir(fileName), ".upload-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err = io.Copy(tmp, body); err != nil {
+		return badUploadError{fmt.Errorf("receiving: %v", err)}
+	}
+	if _, err = tmp.Seek(0, 0); err != nil {
+		return err
+	}
+
+	if err = validatePackage(tmp); err != nil {
+		return badUploadError{err}
+	}
+
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Chmod(0644); err != nil {
+		return err
+	}
+	if err = os.Link(tmp.Name(), fileName); os.IsExist(err) {
+		return errUploadExists
+	}
+	return err
+}
+
+// validatePackage checks if 'r' is a package with a usable 'control' file
+func validatePackage(r io.Reader) error {
+	control, err := extractControlFromIpk(r)
+	if err != nil {
+		return err
+	}
+	archive := &ipkArchive{Header: make(map[string]string)}
+	if err = archive.ControlToHeader(control); err != nil {
+		return err
+	}
+	if archive.Header["Package"] == "" {
+		return fmt.Errorf("missing 'Package' field in 'control'")
+	}
+	return nil
+}
+
+// clientIDAllowed returns true if 'clientID' or one of its parents
+// is listed in 'allowed'. like in the identity mapping a parent of
+// "O=SolSys,OU=Earth,CN=sample" is "O=SolSys,OU=Earth".
+func clientIDAllowed(clientID string, allowed []string) bool {
+	for _, id := range allowed {
+		if clientID == id || strings.HasPrefix(clientID, id+",") {
+			return true
+		}
+	}
+	return false
+}
+
+// loadClientIDs reads a list of client-ids, one per line. empty lines
+// and lines starting with '#' are ignored.
+func loadClientIDs(fileName string) ([]string, error) {
+
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var (
+		ids     []string
+		scanner = bufio.NewScanner(file)
+	)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ids = append(ids, line)
+	}
+	return ids, scanner.Err()
+}
@@ -0,0 +1,154 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2016, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// mockUploadHandler returns an uploadHandler for 'root' which accepts
+// the token "ci" (client-id "O=SolSys,OU=Build,CN=ci") and the token
+// "guest" (client-id "O=Partner,CN=guest", not allowed to upload)
+func mockUploadHandler(t *testing.T, root, cache string) *uploadHandler {
+
+	tokens := filepath.Join(cache, "..", "tokens")
+	if err := ioutil.WriteFile(tokens, []byte("ci O=SolSys,OU=Build,CN=ci\nguest O=Partner,CN=guest\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	auth := &clientAuth{}
+	if err := auth.Load(tokens, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	return &uploadHandler{
+		Root:    root,
+		Cache:   cache,
+		Opts:    &scanOptions{nworkers: 1, gzipper: gzGolang},
+		Clients: []string{"O=SolSys,OU=Build"},
+		Auth:    auth,
+		Next:    http.NotFoundHandler(),
+	}
+}
+
+// putRequest creates a PUT request as sent via tls with 'token'
+func putRequest(reqPath, token string, body []byte) *http.Request {
+	r := httptest.NewRequest("PUT", reqPath, bytes.NewReader(body))
+	r.TLS = &tls.ConnectionState{}
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	return r
+}
+
+func TestUploadHandler(t *testing.T) {
+
+	root, cache, cleanup := mockRoot(t)
+	defer cleanup()
+
+	var (
+		uh  = mockUploadHandler(t, root, cache)
+		gz  = func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }
+		ipk = mockIpk(t, "control.tar.gz", gz)
+	)
+
+	samples := []struct {
+		reqPath string
+		token   string
+		noTLS   bool
+		body    []byte
+		code    int
+	}{
+		{"/stable/bar_1.0-r0_all.ipk", "", false, ipk, http.StatusUnauthorized},
+		{"/stable/bar_1.0-r0_all.ipk", "ci", true, ipk, http.StatusUnauthorized},
+		{"/stable/bar_1.0-r0_all.ipk", "unknown", false, ipk, http.StatusUnauthorized},
+		{"/stable/bar_1.0-r0_all.ipk", "guest", false, ipk, http.StatusForbidden},
+		{"/stable/bar_1.0-r0_all.txt", "ci", false, ipk, http.StatusBadRequest},
+		{"/stable/bar_1.0-r0_all.ipk", "ci", false, []byte("no ipk"), http.StatusBadRequest},
+		{"/stable/bar_1.0-r0_all.ipk", "ci", false, ipk, http.StatusCreated},
+		{"/stable/bar_1.0-r0_all.ipk", "ci", false, ipk, http.StatusConflict},
+		{"/foo_1.0-r0_all.ipk", "ci", false, ipk, http.StatusConflict},
+	}
+
+	for i, sample := range samples {
+		r := putRequest(sample.reqPath, sample.token, sample.body)
+		if sample.noTLS {
+			r.TLS = nil
+		}
+		w := httptest.NewRecorder()
+		uh.ServeHTTP(w, r)
+		if w.Code != sample.code {
+			t.Errorf("sample %d: %s: expected %d, got %d", i, sample.reqPath, sample.code, w.Code)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(cache, "stable", "Packages")); err != nil {
+		t.Errorf("expected the uploaded package to be indexed: %v", err)
+	}
+
+	// only the packages are left behind
+	entries, _ := ioutil.ReadDir(filepath.Join(root, "stable"))
+	if len(entries) != 1 || entries[0].Name() != "bar_1.0-r0_all.ipk" {
+		t.Errorf("expected only the uploaded package in %q, got %d entries", "stable", len(entries))
+	}
+
+	// other methods are passed on
+	w := httptest.NewRecorder()
+	uh.ServeHTTP(w, httptest.NewRequest("GET", "/stable/bar_1.0-r0_all.ipk", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("GET: expected %d from 'Next', got %d", http.StatusNotFound, w.Code)
+	}
+}
+
+// concurrent uploads of the same package: exactly one wins
+func TestStoreUploadConcurrent(t *testing.T) {
+
+	root, _, cleanup := mockRoot(t)
+	defer cleanup()
+
+	var (
+		gz       = func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }
+		ipk      = mockIpk(t, "control.tar.gz", gz)
+		fileName = filepath.Join(root, "bar_1.0-r0_all.ipk")
+		errs     = make([]error, 8)
+		wg       sync.WaitGroup
+	)
+
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = storeUpload(fileName, bytes.NewReader(ipk))
+		}(i)
+	}
+	wg.Wait()
+
+	var stored int
+	for i, err := range errs {
+		switch err {
+		case nil:
+			stored++
+		case errUploadExists:
+		default:
+			t.Errorf("upload %d: %v", i, err)
+		}
+	}
+	if stored != 1 {
+		t.Errorf("expected exactly 1 stored upload, got %d", stored)
+	}
+}
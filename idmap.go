@@ -10,6 +10,7 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -19,6 +20,7 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 )
 
 // the Identity-folder contains a bunch of subfolders. the name of each subfolder is
@@ -34,67 +36,156 @@ import (
 //                                            /root/ipk-folder1 )
 //                     special [ipk-folder2] (text file, containing "ipk-folder2",
 //                                            maps request "/special" to /root/ipk-folder2 )
+//         client-id-1,sub-id/
+//                     ipk-folder1 [deny]    (text file, containing "deny", revokes
+//                                            "/ipk-folder1" inherited from client-id-1 )
+//         client-id-2/
+//                     .deny                 (blocks client-id-2 and all client-ids
+//                                            starting with "client-id-2," )
 //
 type clientIDMuxer struct {
-	Folder string         // folder to use for lookup client-id-requests
-	Muxer  *http.ServeMux // hold the real worker
+	Root     string         // -root, see opkgConfTo()
+	Cache    string         // -cache, see opkgConfTo()
+	Mapping  idMapping      // resolves the requests of a client-id
+	Muxer    *http.ServeMux // hold the real worker
+	Auth     *clientAuth    // derives the client-id, see -client-id, -auth-tokens and -auth-htpasswd
+
+	mu sync.RWMutex // guards Mapping, see SetMapping()
+}
+
+// idMapping resolves the request path of a client-id to the path
+// below -root. implemented by dirMapping (the identity folder) and
+// fileMapping (a .json file).
+type idMapping interface {
+	// Map returns the path below -root for 'reqPath' or
+	// errNotMapped if 'clientID' can't see 'reqPath'
+	Map(clientID, reqPath string) (string, error)
+
+	// Feeds returns all feeds 'clientID' can see:
+	// feed => directory below -root
+	Feeds(clientID string) (map[string]string, error)
+
+	// Rules returns the feeds of 'clientID' including the denied
+	// ones (mapped to _DenyMapping)
+	Rules(clientID string) (map[string]string, error)
 }
 
-// looks up the first certificate to get the client-id. based upon the client-id
-// we lookup the client-directory and, based upon the request, the mapping to the
-// real handler.
+var errNotMapped = errors.New("not mapped")
+
+const (
+	// _DenyMapping as the target of a mapping revokes the feed (and
+	// everything below it) for the client-id and its sub-ids
+	_DenyMapping = "deny"
+
+	// _DenyFile in the folder of a client-id blocks the client-id
+	// and all its sub-ids
+	_DenyFile = ".deny"
+)
+
+// newIDMapping returns the idMapping for -idmap: either a folder
+// (dirMapping) or a file (fileMapping)
+func newIDMapping(name string) (idMapping, error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return &dirMapping{Folder: name, fs: &fsFileProbe{}}, nil
+	}
+	return loadIDMapFile(name)
+}
+
+// SetMapping replaces the Mapping used for the lookups (eg. on SIGHUP)
+func (muxer *clientIDMuxer) SetMapping(mapping idMapping) {
+	muxer.mu.Lock()
+	muxer.Mapping = mapping
+	muxer.mu.Unlock()
+}
+
+func (muxer *clientIDMuxer) mapping() idMapping {
+	muxer.mu.RLock()
+	defer muxer.mu.RUnlock()
+	return muxer.Mapping
+}
+
+// looks up the first certificate (or the token or basic credentials) to get the
+// client-id. based upon the client-id we lookup the client-directory and, based
+// upon the request, the mapping to the real handler.
 func (muxer *clientIDMuxer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
-	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+	clientID, method := muxer.Auth.of(r)
+	if method == authNone {
+		muxer.Auth.challenge(w)
 		writeError(http.StatusUnauthorized, w, r)
 		return
 	}
-
-	cert := r.TLS.PeerCertificates[0]
-	clientID := clientIDByName(&cert.Subject)
+	logClientID(r, clientID)
+	if clientID == "" {
+		writeError(http.StatusForbidden, w, r)
+		return
+	}
 
 	// TODO: do we want this?
 	w.Header().Set("Kellner-Client-Id", clientID)
 
-	// TODO: decide how we treat "/" requests ...
-	// we could deliver opkg.conf containing all the valid repos
-	// or something like that?
-	if r.URL.Path == "/" {
-		writeError(http.StatusForbidden, w, r)
+	// "/" delivers an opkg.conf containing all the feeds of the client,
+	// browsers get the list of these feeds instead
+	if r.URL.Path == "/" && strings.Contains(r.Header.Get("Accept"), "text/html") {
+		muxer.serveFeeds(w, r, clientID)
 		return
 	}
-
-	fs := fsFileProbe{}
-	mapFile, mappedPath, fi, err := findMappingFile(r.URL.Path, muxer.Folder, clientID, ",", &fs)
-
-	if fi == nil || err != nil {
-		http.NotFound(w, r)
+	if r.URL.Path == "/" || r.URL.Path == "/opkg.conf" {
+		muxer.serveOpkgConf(w, r, clientID)
 		return
 	}
 
-	// TODO: decide how to treat a directory
-	if fi.IsDir() {
-		log.Println("fi is a directory, is 404 ok?")
+	mappedPath, err := muxer.mapping().Map(clientID, r.URL.Path)
+	if err == errNotMapped {
 		http.NotFound(w, r)
 		return
 	}
+	if err != nil {
+		log.Printf("warning: mapping %q for %q yields %v", r.URL.Path, clientID, err)
+		writeError(http.StatusInternalServerError, w, r)
+		return
+	}
 
-	// if the file is not empty, the content defines the mapping
-	if fi.Size() > 0 {
-		content, err := ioutil.ReadFile(mapFile)
+	// the listing of a mapped directory has to link to the paths the
+	// client sees and not to the mapped ones. denied sub-feeds are not
+	// listed.
+	if fi, err := os.Stat(filepath.Join(muxer.Root, filepath.FromSlash(mappedPath))); err == nil && fi.IsDir() {
+		hidden, err := muxer.hiddenDirs(clientID, r.URL.Path, mappedPath, true)
 		if err != nil {
-			log.Printf("warning: reading %q yields %v", mapFile, err)
+			log.Printf("warning: collecting the feeds for %q yields %v", clientID, err)
 			writeError(http.StatusInternalServerError, w, r)
 			return
 		}
-		mappedPath = string(bytes.TrimSpace(content))
+		r.Header.Add(_ExtraLogKey, fmt.Sprintf("mappedRequest %q: %s => %s (listing)",
+			clientID, r.URL.Path, mappedPath))
+		renderIndexAs(w, r, muxer.Root, muxer.Cache, mappedPath, r.URL.Path, hidden)
+		return
 	}
 
 	mappedRequest := *r
 	mappedRequest.URL, _ = url.Parse(r.URL.String())
-	mappedRequest.URL.Path = cleanPath(path.Join(mappedPath, path.Base(r.URL.Path)))
+	mappedRequest.URL.Path = cleanPath(mappedPath)
 	mappedRequest.RequestURI = mappedRequest.URL.Path
 
+	// the export of a mapped directory leaves out the sub-feeds the
+	// client sees differently: denied or mapped elsewhere
+	if isExportName(path.Base(mappedPath)) {
+		hidden, err := muxer.hiddenDirs(clientID, path.Dir(r.URL.Path), path.Dir(mappedPath), false)
+		if err != nil {
+			log.Printf("warning: collecting the feeds for %q yields %v", clientID, err)
+			writeError(http.StatusInternalServerError, w, r)
+			return
+		}
+		r.Header.Add(_ExtraLogKey, fmt.Sprintf("mappedRequest %q: %s => %s (export)",
+			clientID, r.URL.Path, mappedPath))
+		exportTar(w, &mappedRequest, muxer.Root, muxer.Cache, hidden)
+		return
+	}
+
 	handler, matchingPattern := muxer.Muxer.Handler(&mappedRequest)
 
 	r.Header.Add(_ExtraLogKey,
@@ -104,42 +195,209 @@ func (muxer *clientIDMuxer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	handler.ServeHTTP(w, &mappedRequest)
 }
 
-func findMappingFile(name, folder, id, sep string, fs fileProbe) (mapFile string, needle string, fi os.FileInfo, err error) {
+// hiddenDirs returns the directories below -root ("/stable/armv7")
+// which must not be delivered as part of the directory 'reqDir' the
+// client sees (mapped to 'mappedDir'): the denied sub-feeds and, if
+// not 'deniedOnly', the sub-feeds mapped elsewhere.
+func (muxer *clientIDMuxer) hiddenDirs(clientID, reqDir, mappedDir string, deniedOnly bool) (map[string]bool, error) {
+
+	rules, err := muxer.mapping().Rules(clientID)
+	if err != nil {
+		return nil, err
+	}
 
 	var (
-		needleFile = path.Clean(name)
-		needleDir  = path.Dir(needleFile)
+		hidden = make(map[string]bool)
+		base   = strings.Trim(path.Clean("/"+reqDir), "/")
 	)
+	for feed, dir := range rules {
+		if base != "" && !strings.HasPrefix(feed, base+"/") {
+			continue
+		}
+		var natural = path.Join("/", mappedDir, strings.TrimPrefix(feed, base+"/"))
+		if dir == _DenyMapping || (!deniedOnly && path.Join("/", dir) != natural) {
+			hidden[natural] = true
+		}
+	}
+	return hidden, nil
+}
+
+// serveFeeds renders the list of feeds 'clientID' can see
+func (muxer *clientIDMuxer) serveFeeds(w http.ResponseWriter, r *http.Request, clientID string) {
+	feeds, err := muxer.mapping().Feeds(clientID)
+	if err != nil {
+		log.Printf("warning: collecting the feeds for %q yields %v", clientID, err)
+		writeError(http.StatusInternalServerError, w, r)
+		return
+	}
+	renderFeeds(w, r, muxer.Root, feeds)
+}
+
+// dirMapping implements idMapping based upon the identity folder
+// described above
+type dirMapping struct {
+	Folder string
+	fs     fileProbe
+}
+
+func (dm *dirMapping) Map(clientID, reqPath string) (string, error) {
+	feeds, err := dm.Rules(clientID)
+	if err != nil {
+		return "", err
+	}
+	return mapByFeeds(feeds, reqPath)
+}
+
+func (dm *dirMapping) Feeds(clientID string) (map[string]string, error) {
+	feeds, err := dm.Rules(clientID)
+	if err != nil {
+		return nil, err
+	}
+	return grantedFeeds(feeds), nil
+}
+
+func (dm *dirMapping) Rules(clientID string) (map[string]string, error) {
 
-	for id != "" {
-
-		base := filepath.Join(folder, id)
-		needle = needleFile
-
-		// first try  /cdir/request/file.ipk
-		// then       /cdir/request
-		//
-		// both should find the mapping file /cdir/request
-		// TODO:      /cidr/request/subfolder/file.ipk
-		mapFile = filepath.Join(base, needle)
-		if fi, err = fs.Stat(mapFile); err != nil {
-			needle = needleDir
-			mapFile = filepath.Join(base, needle)
-			fi, err = fs.Stat(mapFile)
+	var feeds = make(map[string]string)
+	if dm.blocked(clientID) {
+		return feeds, nil
+	}
+
+	// let the more specific ids override the general ones
+	ids := parentIDs(clientID)
+	for i := len(ids) - 1; i >= 0; i-- {
+		idFeeds, err := readMappingDir(filepath.Join(dm.Folder, ids[i]))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
 		}
+		overlayFeeds(feeds, idFeeds)
+	}
+	return feeds, nil
+}
 
-		if fi != nil && !fi.IsDir() {
-			break
+// blocked returns true if the folder of 'clientID' or of one of its
+// parents contains _DenyFile
+func (dm *dirMapping) blocked(clientID string) bool {
+	for _, id := range parentIDs(clientID) {
+		if fi, err := dm.fs.Stat(filepath.Join(dm.Folder, id, _DenyFile)); err == nil && !fi.IsDir() {
+			return true
 		}
+	}
+	return false
+}
 
-		pos := strings.LastIndexAny(id, sep)
-		if pos <= 0 {
-			break
+// parentIDs returns 'clientID' and all its parents, the most
+// specific first: "O=a,OU=b" => ["O=a,OU=b", "O=a"]
+func parentIDs(clientID string) []string {
+	var ids = []string{clientID}
+	for id := clientID; strings.LastIndexAny(id, ",") > 0; {
+		id = id[:strings.LastIndexAny(id, ",")]
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// overlayFeeds puts the more specific 'idFeeds' over 'feeds'. a feed
+// mapped to _DenyMapping revokes the feeds below it as well: denying
+// "stable" revokes an inherited "stable/armv7".
+func overlayFeeds(feeds, idFeeds map[string]string) {
+	for feed, dir := range idFeeds {
+		if dir != _DenyMapping {
+			continue
+		}
+		for other := range feeds {
+			if strings.HasPrefix(other, feed+"/") {
+				delete(feeds, other)
+			}
+		}
+		feeds[feed] = dir
+	}
+	for feed, dir := range idFeeds {
+		if dir != _DenyMapping {
+			feeds[feed] = dir
 		}
-		id = id[:pos]
 	}
+}
+
+// mapByFeeds maps 'reqPath' via the longest feed of 'feeds' (see
+// idMapping.Rules()) it is in: "stable/armv7/sub/file.ipk" tries
+// "stable/armv7/sub/file.ipk", then "stable/armv7/sub", then
+// "stable/armv7" ... everything below the feed is mapped along:
+// /feed/sub/dir/file.ipk => /dir/sub/dir/file.ipk
+func mapByFeeds(feeds map[string]string, reqPath string) (string, error) {
+	var rest = strings.TrimPrefix(path.Clean("/"+reqPath), "/")
+	for feed := rest; feed != "." && feed != ""; feed = path.Dir(feed) {
+		if dir, ok := feeds[feed]; ok {
+			if dir == _DenyMapping {
+				break
+			}
+			return path.Join("/", dir, strings.TrimPrefix(rest, feed)), nil
+		}
+	}
+	return "", errNotMapped
+}
+
+// grantedFeeds returns 'feeds' without the denied ones
+func grantedFeeds(feeds map[string]string) map[string]string {
+	var granted = make(map[string]string, len(feeds))
+	for feed, dir := range feeds {
+		if dir != _DenyMapping {
+			granted[feed] = dir
+		}
+	}
+	return granted
+}
+
+// readMappingDir reads all mapping files in 'dir' and its subfolders:
+// feed => directory. the feed of a mapping file in a subfolder is
+// "subfolder/name" (eg. "stable/armv7").
+func readMappingDir(dir string) (map[string]string, error) {
+	var feeds = make(map[string]string)
+	return feeds, readMappingDirTo(feeds, dir, "")
+}
 
-	return mapFile, needle, fi, err
+func readMappingDirTo(feeds map[string]string, dir, prefix string) error {
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.Name() == _DenyFile {
+			continue
+		}
+		var (
+			name = path.Join(prefix, entry.Name())
+			file = filepath.Join(dir, entry.Name())
+		)
+		if entry.IsDir() {
+			if err = readMappingDirTo(feeds, file, name); err != nil {
+				return err
+			}
+			continue
+		}
+		if feeds[name], err = readMappingFile(file, entry, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readMappingFile returns the target of the mapping file 'mapFile': if
+// the file is not empty, the content defines the mapping, otherwise
+// 'name' is the target.
+func readMappingFile(mapFile string, fi os.FileInfo, name string) (string, error) {
+	if fi.Size() == 0 {
+		return name, nil
+	}
+	content, err := ioutil.ReadFile(mapFile)
+	if err != nil {
+		return "", fmt.Errorf("reading %q: %v", mapFile, err)
+	}
+	return string(bytes.TrimSpace(content)), nil
 }
 
 func writeError(code int, w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,194 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2016, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// fileMapping implements idMapping based upon a single .json file
+// instead of the identity folder:
+//
+//	{
+//	  "clients": [
+//	    {"id": "O=SolSys", "feeds": {"all": "all"}},
+//	    {"id": "O=SolSys,OU=Earth", "feeds": {"core2-64": "core2-64"}},
+//	    {"id": "O=SolSys,OU=Earth,CN=sample", "match": "exact", "feeds": {"subset": "secret"}},
+//	    {"id": "O=SolSys,OU=*,CN=build-*", "match": "glob", "feeds": {"ci": "ci/stable"}},
+//	    {"id": "O=SolSys,OU=Contractors", "feeds": {"secret": "deny"}},
+//	    {"id": "O=SolSys,OU=Mars", "deny": true}
+//	  ]
+//	}
+//
+// "match" is either "prefix" (default, like the identity folder: "O=SolSys"
+// matches "O=SolSys" and "O=SolSys,OU=Earth,..."), "exact" or "glob"
+// (matched per RDN, see globRDNs()).
+// "feeds" maps the beginning of the request path (the feed the client
+// sees, eg. "all" or "stable/armv7") to a directory below -root. the
+// longest matching feed wins. if several entries match a
+// client-id, the most specific one wins per feed: "exact" before "glob"
+// before "prefix", longer prefixes before shorter ones. a feed mapped to
+// "deny" revokes the inherited feed (and the feeds below it), "deny": true
+// blocks all client-ids matching the entry.
+type fileMapping struct {
+	Clients []idMapRule `json:"clients"`
+}
+
+type idMapRule struct {
+	ID    string            `json:"id"`
+	Match string            `json:"match,omitempty"`
+	Feeds map[string]string `json:"feeds"`
+	Deny  bool              `json:"deny,omitempty"`
+}
+
+func loadIDMapFile(name string) (*fileMapping, error) {
+
+	content, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var fm fileMapping
+	if err = json.Unmarshal(content, &fm); err != nil {
+		return nil, fmt.Errorf("parsing %q: %v", name, err)
+	}
+
+	for i, rule := range fm.Clients {
+		if rule.ID == "" {
+			return nil, fmt.Errorf("%q: entry %d: missing \"id\"", name, i)
+		}
+		switch rule.Match {
+		case "", "prefix", "exact":
+		case "glob":
+			if _, err = path.Match(rule.ID, ""); err != nil {
+				return nil, fmt.Errorf("%q: entry %d: invalid glob %q: %v", name, i, rule.ID, err)
+			}
+		default:
+			return nil, fmt.Errorf("%q: entry %d: unknown \"match\" %q", name, i, rule.Match)
+		}
+		for feed := range rule.Feeds {
+			if feed == "" || feed != strings.Trim(path.Clean(feed), "/") || strings.HasPrefix(feed, "..") {
+				return nil, fmt.Errorf("%q: entry %d: invalid feed name %q", name, i, feed)
+			}
+		}
+	}
+	return &fm, nil
+}
+
+func (rule *idMapRule) matches(clientID string) bool {
+	switch rule.Match {
+	case "exact":
+		return clientID == rule.ID
+	case "glob":
+		return globRDNs(rule.ID, clientID)
+	}
+	return clientID == rule.ID || strings.HasPrefix(clientID, rule.ID+",")
+}
+
+// globRDNs matches 'clientID' against 'pattern' RDN by RDN: both must
+// have the same number of RDNs and a '*' does not reach beyond its
+// RDN. "O=SolSys,OU=*,CN=build-*" does not match
+// "O=SolSys,OU=Earth,CN=build-x,OU=Other".
+func globRDNs(pattern, clientID string) bool {
+	var patterns, rdns = strings.Split(pattern, ","), strings.Split(clientID, ",")
+	if len(patterns) != len(rdns) {
+		return false
+	}
+	for i := range patterns {
+		if ok, _ := path.Match(patterns[i], rdns[i]); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// specificity orders the rules: the higher, the more specific
+func (rule *idMapRule) specificity() int {
+	switch rule.Match {
+	case "exact":
+		return 2 << 16
+	case "glob":
+		return 1 << 16
+	}
+	return len(rule.ID)
+}
+
+func (fm *fileMapping) Feeds(clientID string) (map[string]string, error) {
+	return grantedFeeds(fm.feeds(clientID)), nil
+}
+
+func (fm *fileMapping) Rules(clientID string) (map[string]string, error) {
+	return fm.feeds(clientID), nil
+}
+
+// feeds returns the feeds 'clientID' sees: feed => directory below -root
+// or _DenyMapping
+func (fm *fileMapping) feeds(clientID string) map[string]string {
+
+	var rules []*idMapRule
+	for i := range fm.Clients {
+		if fm.Clients[i].matches(clientID) {
+			rules = append(rules, &fm.Clients[i])
+		}
+	}
+	sort.SliceStable(rules, func(i, j int) bool {
+		return rules[i].specificity() < rules[j].specificity()
+	})
+
+	var feeds = make(map[string]string)
+	for _, rule := range rules {
+		if rule.Deny {
+			return map[string]string{}
+		}
+		overlayFeeds(feeds, rule.Feeds)
+	}
+	return feeds
+}
+
+func (fm *fileMapping) Map(clientID, reqPath string) (string, error) {
+	return mapByFeeds(fm.feeds(clientID), reqPath)
+}
+
+// exportIDMapDir writes the mappings of the identity folder 'folder'
+// as .json (see fileMapping) to 'w'
+func exportIDMapDir(w io.Writer, folder string) error {
+
+	ids, err := ioutil.ReadDir(folder)
+	if err != nil {
+		return err
+	}
+
+	var fm = fileMapping{Clients: []idMapRule{}}
+	for _, id := range ids {
+		if !id.IsDir() {
+			continue
+		}
+		feeds, err := readMappingDir(filepath.Join(folder, id.Name()))
+		if err != nil {
+			return err
+		}
+		_, err = os.Stat(filepath.Join(folder, id.Name(), _DenyFile))
+		fm.Clients = append(fm.Clients, idMapRule{ID: id.Name(), Feeds: feeds, Deny: err == nil})
+	}
+
+	content, err := json.MarshalIndent(&fm, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", content)
+	return err
+}
@@ -9,53 +9,223 @@
 package main
 
 import (
+	"archive/tar"
+	"bytes"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
 
-func TestFindMappingFile(t *testing.T) {
+// mockIDFolder creates an identity folder with the mapping 'files'
+// (file => content) and returns it and a function to remove it
+func mockIDFolder(t *testing.T, files map[string]string) (string, func()) {
+	folder, err := ioutil.TempDir("", "kellner-idmap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		name = filepath.Join(folder, filepath.FromSlash(name))
+		if err = os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return folder, func() { os.RemoveAll(folder) }
+}
+
+func TestDirMapping(t *testing.T) {
 
 	id := "O=SolSys,OU=Earth,CN=snowflake"
-	fs := &mockFS{
-		fs: map[string]os.FileInfo{
-			"ids/O=SolSys":                              mockFileDir(_MockDir),
-			"ids/O=SolSys/level0":                       mockFileDir(_MockFile),
-			"ids/O=SolSys/overlay":                      mockFileDir(_MockFile),
-			"ids/O=SolSys,OU=Earth":                     mockFileDir(_MockDir),
-			"ids/O=SolSys,OU=Earth/level1":              mockFileDir(_MockFile),
-			"ids/O=SolSys,OU=Earth/overlay":             mockFileDir(_MockFile),
-			"ids/O=SolSys,OU=Earth,CN=snowflake":        mockFileDir(_MockDir),
-			"ids/O=SolSys,OU=Earth,CN=snowflake/level2": mockFileDir(_MockFile),
-		},
-		t: t,
+	folder, cleanup := mockIDFolder(t, map[string]string{
+		"O=SolSys/level0":                              "",
+		"O=SolSys/overlay":                             "level0",
+		"O=SolSys,OU=Earth/level1":                     "",
+		"O=SolSys,OU=Earth/overlay":                    "level1",
+		"O=SolSys,OU=Earth,CN=snowflake/level2":        "",
+		"O=SolSys,OU=Earth,CN=snowflake/stable/armv7":  "",
+		"O=SolSys,OU=Earth,CN=snowflakes/stable/other": "",
+	})
+	defer cleanup()
+	dm := &dirMapping{Folder: folder, fs: &fsFileProbe{}}
+
+	samples := []struct{ in, out string }{
+		{"/level2/file", "/level2/file"},
+		{"/level2/", "/level2"},
+		{"/level1/file", "/level1/file"},
+		{"/overlay/file", "/level1/file"},
+		{"/level0", "/level0"},
+		{"/level0/", "/level0"},
+		{"/level0/a.ipk", "/level0/a.ipk"},
+		{"/level0/sub/dir/a.ipk", "/level0/sub/dir/a.ipk"},
+		{"/stable/armv7/Packages", "/stable/armv7/Packages"},
+		{"/stable/armv7/sub/file", "/stable/armv7/sub/file"},
+		{"/stable/armv7/../../level0/a.ipk", "/level0/a.ipk"},
+		{"/stable", ""},
+		{"/stable/file", ""},
+		{"/stable/other", ""},
+		{"/", ""},
+		{"/404/a.ipk", ""},
+	}
+
+	for _, sample := range samples {
+		out, err := dm.Map(id, sample.in)
+		if sample.out == "" {
+			if err != errNotMapped {
+				t.Errorf("Map(%q): expected errNotMapped, got %q %v", sample.in, out, err)
+			}
+			continue
+		}
+		if err != nil || out != sample.out {
+			t.Errorf("Map(%q): expected %q, got %q %v", sample.in, sample.out, out, err)
+		}
+	}
+
+	// the .deny of a parent blocks everything
+	dm.fs = &mockFS{
+		fs: map[string]os.FileInfo{filepath.Join(folder, "O=SolSys,OU=Earth", _DenyFile): mockFileDir(_MockFile)},
+		t:  t,
+	}
+	if out, err := dm.Map(id, "/level2/file"); err != errNotMapped {
+		t.Errorf("Map(%q): expected errNotMapped for a blocked id, got %q %v", "/level2/file", out, err)
+	}
+}
+
+// the identity folder and its -idmap-export resolve every request
+// alike: the longest feed over the merged mappings of all parent ids
+// wins, "stable/armv7" of "O=SolSys" beats "stable" of its child
+func TestIDMapExportMapsAlike(t *testing.T) {
+
+	folder, cleanup := mockIDFolder(t, map[string]string{
+		"O=SolSys/stable/armv7":                "ci/armv7",
+		"O=SolSys,OU=Earth/stable":             "testing",
+		"O=SolSys,OU=Earth/all":                "",
+		"O=SolSys,OU=Mars/stable":              "deny",
+		"O=SolSys,OU=Mars,CN=rover/stable/x86": "",
+		"O=SolSys,OU=Venus/.deny":              "",
+	})
+	defer cleanup()
+
+	var export bytes.Buffer
+	if err := exportIDMapDir(&export, folder); err != nil {
+		t.Fatal(err)
+	}
+	mapFile := filepath.Join(folder, "..", filepath.Base(folder)+".json")
+	if err := ioutil.WriteFile(mapFile, export.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(mapFile)
+
+	var (
+		dm      = &dirMapping{Folder: folder, fs: &fsFileProbe{}}
+		fm, err = loadIDMapFile(mapFile)
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sample := range []struct{ id, in, out string }{
+		{"O=SolSys,OU=Earth,CN=dev", "/stable/armv7/a.ipk", "/ci/armv7/a.ipk"},
+		{"O=SolSys,OU=Earth,CN=dev", "/stable/x86/a.ipk", "/testing/x86/a.ipk"},
+		{"O=SolSys,OU=Mars,CN=rover", "/stable/x86/a.ipk", "/stable/x86/a.ipk"},
+	} {
+		if out, err := dm.Map(sample.id, sample.in); err != nil || out != sample.out {
+			t.Errorf("dirMapping.Map(%q, %q): expected %q, got %q %v", sample.id, sample.in, sample.out, out, err)
+		}
+	}
+
+	ids := []string{
+		"O=SolSys", "O=SolSys,OU=Earth,CN=dev", "O=SolSys,OU=Mars",
+		"O=SolSys,OU=Mars,CN=rover", "O=SolSys,OU=Venus,CN=probe", "O=Other",
+	}
+	reqs := []string{
+		"/stable", "/stable/a.ipk", "/stable/armv7", "/stable/armv7/a.ipk",
+		"/stable/x86/a.ipk", "/all/Packages", "/404",
+	}
+	for _, id := range ids {
+		dmRules, dmErr := dm.Rules(id)
+		fmRules, fmErr := fm.Rules(id)
+		if dmErr != nil || fmErr != nil || !reflect.DeepEqual(dmRules, fmRules) {
+			t.Errorf("Rules(%q): dirMapping %v %v, fileMapping %v %v", id, dmRules, dmErr, fmRules, fmErr)
+		}
+		for _, req := range reqs {
+			dmOut, dmErr := dm.Map(id, req)
+			fmOut, fmErr := fm.Map(id, req)
+			if dmOut != fmOut || dmErr != fmErr {
+				t.Errorf("Map(%q, %q): dirMapping %q %v, fileMapping %q %v", id, req, dmOut, dmErr, fmOut, fmErr)
+			}
+		}
 	}
+}
 
-	samples := []struct{ in, mf, mp string }{
-		// expect success
-		{"/level2/file", "ids/O=SolSys,OU=Earth,CN=snowflake/level2", "/level2"},
-		{"/level2/", "ids/O=SolSys,OU=Earth,CN=snowflake/level2", "/level2"},
-		{"/level1/file", "ids/O=SolSys,OU=Earth/level1", "/level1"},
-		{"/overlay/file", "ids/O=SolSys,OU=Earth/overlay", "/overlay"},
-		{"/level0", "ids/O=SolSys/level0", "/level0"},
+func TestDirMappingDeny(t *testing.T) {
 
-		// expect "failure" (indicated by "/" and the "toplevel" subject)
-		{"/404", "ids/O=SolSys", "/"},
+	folder, err := ioutil.TempDir("", "kellner-idmap")
+	if err != nil {
+		t.Fatal(err)
 	}
+	defer os.RemoveAll(folder)
 
-	test := func(path, expected_mf, expected_path string) {
-		mf, mp, fi, err := findMappingFile(path, "ids", id, ",", fs)
-		t.Logf("findMappingFile(%q): %q %q %v %v", path, mf, mp, fi, err)
-		if mf != expected_mf {
-			t.Fatalf("findMappingFile(%q): expected mapFile to be %q, got %q", path, expected_mf, mf)
+	files := map[string]string{
+		"O=SolSys/all":                    "",
+		"O=SolSys/secret":                 "",
+		"O=SolSys/stable/armv7":           "",
+		"O=SolSys,OU=Contractors/secret":  "deny",
+		"O=SolSys,OU=Contractors/stable":  "deny",
+		"O=SolSys,OU=Contractors/extra":   "",
+		"O=SolSys,OU=Mars/.deny":          "",
+		"O=SolSys,OU=Mars,CN=rover/extra": "",
+	}
+	for name, content := range files {
+		name = filepath.Join(folder, name)
+		if err = os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
 		}
-		if mp != expected_path {
-			t.Fatalf("findMappingFile(%q): expected mappedPath to be %q, got %q", path, expected_path, mp)
+		if err = ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
 		}
 	}
 
-	for i := range samples {
-		test(samples[i].in, samples[i].mf, samples[i].mp)
+	dm := &dirMapping{Folder: folder, fs: &fsFileProbe{}}
+
+	samples := []struct{ id, in, out string }{
+		{"O=SolSys,OU=Earth", "/secret/a.ipk", "/secret/a.ipk"},
+		{"O=SolSys,OU=Contractors,CN=joe", "/all/a.ipk", "/all/a.ipk"},
+		{"O=SolSys,OU=Contractors,CN=joe", "/extra/a.ipk", "/extra/a.ipk"},
+		{"O=SolSys,OU=Contractors,CN=joe", "/secret/a.ipk", ""},
+		{"O=SolSys,OU=Contractors,CN=joe", "/stable/armv7/a.ipk", ""},
+		{"O=SolSys,OU=Mars", "/all/a.ipk", ""},
+		{"O=SolSys,OU=Mars,CN=rover", "/extra/a.ipk", ""},
+		{"O=SolSys,OU=Mars,CN=rover", "/.deny", ""},
+	}
+	for _, sample := range samples {
+		out, err := dm.Map(sample.id, sample.in)
+		if sample.out == "" {
+			if err != errNotMapped {
+				t.Errorf("Map(%q, %q): expected errNotMapped, got %q %v", sample.id, sample.in, out, err)
+			}
+			continue
+		}
+		if err != nil || out != sample.out {
+			t.Errorf("Map(%q, %q): expected %q, got %q %v", sample.id, sample.in, sample.out, out, err)
+		}
+	}
+
+	feeds, err := dm.Feeds("O=SolSys,OU=Contractors,CN=joe")
+	if expected := map[string]string{"all": "all", "extra": "extra"}; err != nil || !reflect.DeepEqual(feeds, expected) {
+		t.Errorf("Feeds(): expected %v, got %v %v", expected, feeds, err)
+	}
+	if feeds, err = dm.Feeds("O=SolSys,OU=Mars,CN=rover"); err != nil || len(feeds) != 0 {
+		t.Errorf("Feeds(): expected no feeds, got %v %v", feeds, err)
 	}
 }
 
@@ -86,7 +256,7 @@ func TestMockFS(t *testing.T) {
 		fatal("/folder", fi, err)
 	}
 	if _, err := fs.Stat("/404"); err != os.ErrNotExist {
-		t.Fatal("expected to not find %q, but found it?", "/bar")
+		t.Fatalf("expected to not find %q, but found it?", "/404")
 	}
 
 }
@@ -108,7 +278,7 @@ func (m mockFileDir) IsDir() bool        { return (m == _MockDir) }
 func (m mockFileDir) Sys() interface{}   { return m }
 
 // mockFS implementes the fileProbe interface. it's only purpose
-// is to test findMappingFile
+// is to test the .deny lookup of dirMapping
 type mockFS struct {
 	fs map[string]os.FileInfo
 	t  *testing.T
@@ -123,3 +293,157 @@ func (mock *mockFS) Stat(name string) (os.FileInfo, error) {
 	mock.t.Logf("mockFS.Lstat(%q): %v %v", name, fi, err)
 	return fi, err
 }
+
+func TestFileMapping(t *testing.T) {
+
+	fm := &fileMapping{Clients: []idMapRule{
+		{ID: "O=SolSys", Feeds: map[string]string{"all": "all", "overlay": "level0"}},
+		{ID: "O=SolSys,OU=Earth", Feeds: map[string]string{"overlay": "level1"}},
+		{ID: "O=SolSys,OU=*,CN=snow*", Match: "glob", Feeds: map[string]string{"overlay": "glob"}},
+		{ID: "O=SolSys,OU=Earth,CN=snowflake", Match: "exact", Feeds: map[string]string{"subset": "secret"}},
+		{ID: "O=SolSys,OU=Moon", Feeds: map[string]string{"stable": "stable", "stable/armv7": "ci/armv7"}},
+		{ID: "O=SolSys,OU=Moon,CN=contractor", Feeds: map[string]string{"stable": "deny"}},
+		{ID: "O=SolSys,OU=Venus", Deny: true},
+	}}
+
+	samples := []struct{ id, in, out string }{
+		{"O=SolSys,OU=Earth,CN=snowflake", "/all/Packages", "/all/Packages"},
+		{"O=SolSys,OU=Earth,CN=snowflake", "/overlay/a.ipk", "/glob/a.ipk"},
+		{"O=SolSys,OU=Earth,CN=snowflake", "/subset/armv7/a.ipk", "/secret/armv7/a.ipk"},
+		{"O=SolSys,OU=Earth,CN=other", "/overlay/a.ipk", "/level1/a.ipk"},
+		{"O=SolSys,OU=Earth,CN=snowflake,OU=Other", "/overlay/a.ipk", "/level1/a.ipk"},
+		{"O=SolSys,OU=Earth,OU=Other,CN=snowflake", "/overlay/a.ipk", "/level1/a.ipk"},
+		{"O=SolSys,OU=Mars", "/overlay", "/level0"},
+		{"O=SolSysX", "/all/Packages", ""},
+		{"O=SolSys,OU=Earth,CN=snowflake,L=x", "/subset/a.ipk", ""},
+		{"O=SolSys", "/../all/Packages", "/all/Packages"},
+		{"O=SolSys,OU=Moon", "/stable/armv7/sub/a.ipk", "/ci/armv7/sub/a.ipk"},
+		{"O=SolSys,OU=Moon", "/stable/armv7", "/ci/armv7"},
+		{"O=SolSys,OU=Moon", "/stable/all/a.ipk", "/stable/all/a.ipk"},
+		{"O=SolSys,OU=Moon", "/stable-x/a.ipk", ""},
+		{"O=SolSys,OU=Moon,CN=contractor", "/stable/armv7/a.ipk", ""},
+		{"O=SolSys,OU=Moon,CN=contractor", "/all/a.ipk", "/all/a.ipk"},
+		{"O=SolSys,OU=Venus,CN=probe", "/all/a.ipk", ""},
+	}
+
+	for _, sample := range samples {
+		out, err := fm.Map(sample.id, sample.in)
+		if sample.out == "" {
+			if err != errNotMapped {
+				t.Errorf("Map(%q, %q): expected errNotMapped, got %q %v", sample.id, sample.in, out, err)
+			}
+			continue
+		}
+		if err != nil || out != sample.out {
+			t.Errorf("Map(%q, %q): expected %q, got %q %v", sample.id, sample.in, sample.out, out, err)
+		}
+	}
+}
+
+// tarNames returns the names of the entries of the tar-archive 'raw'
+func tarNames(t *testing.T, raw []byte) []string {
+	var (
+		names []string
+		tr    = tar.NewReader(bytes.NewReader(raw))
+	)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return names
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, header.Name)
+	}
+}
+
+// a sub-feed denied to a client is neither exported, listed nor part
+// of its opkg.conf, no matter how the mapping is stored
+func TestMuxerDeny(t *testing.T) {
+
+	root, cache, cleanup := mockFeeds(t, map[string]string{
+		"stable":       "all",
+		"stable/armv7": "armv7",
+		"stable/x86":   "x86_64",
+	})
+	defer cleanup()
+
+	folder := filepath.Join(root, "..", "identities")
+	for name, content := range map[string]string{
+		"O=SolSys/stable":                        "",
+		"O=SolSys,OU=Contractors/stable/armv7":   "deny",
+		"O=SolSys,OU=Contractors/stable/x86/sub": "", // no effect, there is no stable/x86/sub
+	} {
+		name = filepath.Join(folder, name)
+		os.MkdirAll(filepath.Dir(name), 0755)
+		if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tokens := filepath.Join(root, "..", "tokens")
+	if err := ioutil.WriteFile(tokens, []byte("staff O=SolSys,CN=staff\ncontractor O=SolSys,OU=Contractors,CN=joe\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	auth := &clientAuth{}
+	if err := auth.Load(tokens, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	mappings := map[string]idMapping{
+		"dirMapping": &dirMapping{Folder: folder, fs: &fsFileProbe{}},
+		"fileMapping": &fileMapping{Clients: []idMapRule{
+			{ID: "O=SolSys", Feeds: map[string]string{"stable": "stable"}},
+			{ID: "O=SolSys,OU=Contractors", Feeds: map[string]string{"stable/armv7": "deny"}},
+		}},
+	}
+
+	for name, mapping := range mappings {
+
+		muxer := &clientIDMuxer{Root: root, Cache: cache, Muxer: http.NewServeMux(), Auth: auth}
+		muxer.Muxer.Handle("/", makeIndexHandler(root, cache))
+		muxer.SetMapping(mapping)
+
+		get := func(reqPath, token string) (int, string) {
+			r := httptest.NewRequest("GET", reqPath, nil)
+			r.TLS = &tls.ConnectionState{}
+			r.Header.Set("Authorization", "Bearer "+token)
+			w := httptest.NewRecorder()
+			muxer.ServeHTTP(w, r)
+			return w.Code, w.Body.String()
+		}
+
+		for _, sample := range []struct {
+			token string
+			armv7 bool
+		}{
+			{"staff", true},
+			{"contractor", false},
+		} {
+			var prefix = name + ": " + sample.token
+
+			code, body := get("/stable/.export.tar", sample.token)
+			names := strings.Join(tarNames(t, []byte(body)), " ")
+			if code != http.StatusOK || !strings.Contains(names, "x86/foo_1.0_x86_64.ipk") ||
+				strings.Contains(names, "armv7") != sample.armv7 {
+				t.Errorf("%s: export: expected armv7 %v, got %d %s", prefix, sample.armv7, code, names)
+			}
+
+			code, body = get("/stable", sample.token)
+			if code != http.StatusOK || !strings.Contains(body, "/stable/x86") ||
+				strings.Contains(body, "/stable/armv7") != sample.armv7 {
+				t.Errorf("%s: listing: expected armv7 %v, got %d %s", prefix, sample.armv7, code, body)
+			}
+
+			code, body = get("/opkg.conf", sample.token)
+			if code != http.StatusOK || !strings.Contains(body, "src/gz stable-x86 ") ||
+				strings.Contains(body, "armv7") != sample.armv7 {
+				t.Errorf("%s: opkg.conf: expected armv7 %v, got %d %s", prefix, sample.armv7, code, body)
+			}
+
+			if code, _ = get("/stable/armv7/Packages", sample.token); (code == http.StatusOK) != sample.armv7 {
+				t.Errorf("%s: /stable/armv7/Packages: expected armv7 %v, got %d", prefix, sample.armv7, code)
+			}
+		}
+	}
+}
@@ -12,10 +12,12 @@ import (
 	"archive/tar"
 	"bufio"
 	"bytes"
-	"compress/gzip"
 	"crypto/md5"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"hash"
 	"io"
@@ -25,6 +27,8 @@ import (
 	"path"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/blakesmith/ar"
 )
@@ -36,6 +40,7 @@ type ipkArchive struct {
 	FileInfo     os.FileInfo
 	Md5          string
 	Sha1         string
+	Sha256       string
 	ScanLocation string // location where the ipk was found
 }
 
@@ -66,6 +71,25 @@ func (ipk *ipkArchive) EnhanceHeader() {
 	if ipk.Sha1 != "" {
 		ipk.Header["SHA1"] = ipk.Sha1
 	}
+	if ipk.Sha256 != "" {
+		ipk.Header[ipk.sha256Key()] = ipk.Sha256
+	}
+}
+
+// needsSHA256 tells if the sha256 checksum of the package 'name' is
+// calculated: apt rejects packages without a strong hash, a .deb gets
+// it regardless of -sha256.
+func needsSHA256(name string, doSHA256 bool) bool {
+	return doSHA256 || path.Ext(name) == ".deb"
+}
+
+// sha256Key returns the name of the field carrying the sha256 checksum:
+// opkg expects "SHA256sum" while apt expects "SHA256".
+func (ipk *ipkArchive) sha256Key() string {
+	if path.Ext(ipk.Name) == ".deb" {
+		return "SHA256"
+	}
+	return "SHA256sum"
 }
 
 func (ipk *ipkArchive) DirEntry() dirEntry {
@@ -116,6 +140,9 @@ func (ipk *ipkArchive) ControlAndChecksumTo(w io.Writer) {
 	if ipk.Sha1 != "" {
 		fmt.Fprintf(w, "SHA1: %s\n", ipk.Sha1)
 	}
+	if ipk.Sha256 != "" {
+		fmt.Fprintf(w, "%s: %s\n", ipk.sha256Key(), ipk.Sha256)
+	}
 }
 
 type ipkArchiveChan chan *ipkArchive
@@ -123,12 +150,16 @@ type ipkArchiveChan chan *ipkArchive
 // extract 'control' file from 'reader'. the contents of a 'control' file
 // is a set of key-value pairs as described in
 // https://www.debian.org/doc/debian-policy/ch-controlfields.html
+//
+// the 'control' file is part of the control.tar member, which might be
+// compressed by gzip, xz, zstd or bzip2 (or not at all).
 func extractControlFromIpk(reader io.Reader) (string, error) {
 
 	var (
-		arReader  *ar.Reader
-		tarReader *tar.Reader
-		gzReader  *gzip.Reader
+		arReader    *ar.Reader
+		tarReader   *tar.Reader
+		ctrlReader  io.ReadCloser
+		controlName string
 	)
 
 	arReader = ar.NewReader(reader)
@@ -141,30 +172,32 @@ func extractControlFromIpk(reader io.Reader) (string, error) {
 		}
 
 		// NOTE: strangeley the name of the files end with a "/" ... content error?
-		if header.Name == "control.tar.gz/" || header.Name == "control.tar.gz" {
-			gzReader, err = gzip.NewReader(arReader)
+		name := strings.TrimSuffix(header.Name, "/")
+		if name == "control.tar" || strings.HasPrefix(name, "control.tar.") {
+			ctrlReader, err = decompressReader(name, arReader)
 			if err != nil {
-				return "", fmt.Errorf("analyzing control.tar.gz: %v", err)
+				return "", fmt.Errorf("analyzing %s: %v", name, err)
 			}
+			controlName = name
 			break
 		}
 	}
 
-	if gzReader == nil {
-		return "", fmt.Errorf("missing control.tar.gz entry")
+	if ctrlReader == nil {
+		return "", fmt.Errorf("missing control.tar entry")
 	}
-	defer gzReader.Close()
+	defer ctrlReader.Close()
 
 	buffer := bytes.NewBuffer(nil)
-	tarReader = tar.NewReader(gzReader)
+	tarReader = tar.NewReader(ctrlReader)
 	for {
 		header, err := tarReader.Next()
 		if err != nil && err != io.EOF {
-			return "", fmt.Errorf("extracting control.tar.gz: %v", err)
+			return "", fmt.Errorf("extracting %s: %v", controlName, err)
 		} else if header == nil {
 			break
 		}
-		if header.Name != "./control" {
+		if path.Clean(header.Name) != "control" {
 			continue
 		}
 
@@ -173,21 +206,24 @@ func extractControlFromIpk(reader io.Reader) (string, error) {
 	}
 
 	if buffer.Len() == 0 {
-		return "", fmt.Errorf("missing or empty 'control' file inside 'control.tar.gz'")
+		return "", fmt.Errorf("missing or empty 'control' file inside %q", controlName)
 	}
 	return buffer.String(), nil
 }
 
-func newIpkFromFile(fullName string, doMD5, doSHA1 bool) (*ipkArchive, error) {
+func newIpkFromFile(fullName string, doMD5, doSHA1, doSHA256 bool) (*ipkArchive, error) {
 
 	var (
-		file   *os.File
-		writer = make([]io.Writer, 0, 3)
-		err    error
-		md5er  hash.Hash
-		sha1er hash.Hash
+		file     *os.File
+		writer   = make([]io.Writer, 0, 4)
+		err      error
+		md5er    hash.Hash
+		sha1er   hash.Hash
+		sha256er hash.Hash
 	)
 
+	doSHA256 = needsSHA256(fullName, doSHA256)
+
 	file, err = os.Open(fullName)
 	if err != nil {
 		return nil, fmt.Errorf("openening %q: %v", fullName, err)
@@ -203,6 +239,10 @@ func newIpkFromFile(fullName string, doMD5, doSHA1 bool) (*ipkArchive, error) {
 		sha1er = sha1.New()
 		writer = append(writer, sha1er)
 	}
+	if doSHA256 {
+		sha256er = sha256.New()
+		writer = append(writer, sha256er)
+	}
 
 	tee := io.TeeReader(file, io.MultiWriter(writer...))
 
@@ -221,7 +261,7 @@ func newIpkFromFile(fullName string, doMD5, doSHA1 bool) (*ipkArchive, error) {
 		return nil, fmt.Errorf("header parse error in %q: %v", fullName, err)
 	}
 
-	// consume the rest of the file to calculate md5/sha1
+	// consume the rest of the file to calculate the checksums
 	io.Copy(ioutil.Discard, tee)
 	file.Close() // close to free handles, 'collector' might block freeing otherwise
 
@@ -232,28 +272,110 @@ func newIpkFromFile(fullName string, doMD5, doSHA1 bool) (*ipkArchive, error) {
 	if sha1er != nil {
 		archive.Sha1 = hex.EncodeToString(sha1er.Sum(nil))
 	}
+	if sha256er != nil {
+		archive.Sha256 = hex.EncodeToString(sha256er.Sum(nil))
+	}
 
 	return archive, nil
 }
 
-func newIpkFromCache(name, cachepath string, doMD5, doSHA1 bool) (*ipkArchive, error) {
+// ipkCacheRecord is stored per package in the -cache folder. it holds
+// everything needed to recreate the index entry of the package without
+// opening the package again.
+type ipkCacheRecord struct {
+	Control string
+	Size    int64
+	ModTime time.Time
+	Inode   uint64
+	Md5     string `json:",omitempty"`
+	Sha1    string `json:",omitempty"`
+	Sha256  string `json:",omitempty"`
+}
+
+func newIpkCacheRecord(ipk *ipkArchive) *ipkCacheRecord {
+	return &ipkCacheRecord{
+		Control: ipk.Control,
+		Size:    ipk.FileInfo.Size(),
+		ModTime: ipk.FileInfo.ModTime(),
+		Inode:   fileInode(ipk.FileInfo),
+		Md5:     ipk.Md5,
+		Sha1:    ipk.Sha1,
+		Sha256:  ipk.Sha256,
+	}
+}
+
+// matches returns true if the record describes 'fi' and contains
+// all requested checksums
+func (rec *ipkCacheRecord) matches(fi os.FileInfo, doMD5, doSHA1, doSHA256 bool) bool {
+	switch {
+	case rec.Size != fi.Size(), !rec.ModTime.Equal(fi.ModTime()), rec.Inode != fileInode(fi):
+		return false
+	case doMD5 && rec.Md5 == "", doSHA1 && rec.Sha1 == "", doSHA256 && rec.Sha256 == "":
+		return false
+	}
+	return true
+}
+
+func writeIpkCacheRecord(ipk *ipkArchive, cachepath string) error {
+	var content, err = json.Marshal(newIpkCacheRecord(ipk))
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(genCachedRecordName(ipk.Name, cachepath), content, 0644)
+}
+
+// newIpkFromCache recreates the ipkArchive for the package described by
+// 'fi' from its cache record. an error is returned if there is no record
+// or if the record is out-of-date.
+func newIpkFromCache(fi os.FileInfo, cachepath string, doMD5, doSHA1, doSHA256 bool) (*ipkArchive, error) {
 
 	var (
-		ctrlName = genCachedControlName(name, cachepath)
-		control  []byte
-		err      error
+		recName = genCachedRecordName(fi.Name(), cachepath)
+		record  ipkCacheRecord
+		content []byte
+		err     error
 	)
 
-	if control, err = ioutil.ReadFile(ctrlName); err != nil {
-		return nil, fmt.Errorf("reading cache %q: %v\n", ctrlName, err)
+	doSHA256 = needsSHA256(fi.Name(), doSHA256)
+
+	if content, err = ioutil.ReadFile(recName); err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(content, &record); err != nil {
+		return nil, fmt.Errorf("parsing cache %q: %v", recName, err)
+	}
+	if !record.matches(fi, doMD5, doSHA1, doSHA256) {
+		return nil, errCacheOutdated
 	}
 
-	var archive = &ipkArchive{Name: name,
-		Control: string(control),
-		Header:  make(map[string]string),
+	var archive = &ipkArchive{Name: fi.Name(),
+		Control:  record.Control,
+		Header:   make(map[string]string),
+		FileInfo: fi,
+	}
+	if doMD5 {
+		archive.Md5 = record.Md5
+	}
+	if doSHA1 {
+		archive.Sha1 = record.Sha1
+	}
+	if doSHA256 {
+		archive.Sha256 = record.Sha256
+	}
+	if err = archive.ControlToHeader(archive.Control); err != nil {
+		return nil, fmt.Errorf("header parse error in %q: %v", recName, err)
 	}
-	archive.FileInfo, _ = os.Stat(ctrlName)
-	archive.ControlToHeader(archive.Control)
 
 	return archive, nil
 }
+
+var errCacheOutdated = errors.New("cache record is outdated")
+
+// fileInode returns the inode of 'fi' or 0 if the platform
+// does not provide one
+func fileInode(fi os.FileInfo) uint64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Ino)
+	}
+	return 0
+}
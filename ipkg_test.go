@@ -0,0 +1,89 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2016, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/blakesmith/ar"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+const _TestControl = "Package: foo\nVersion: 1.0-r0\nArchitecture: all\n"
+
+func TestExtractControlFromIpk(t *testing.T) {
+
+	compressors := map[string]func(w io.Writer) io.WriteCloser{
+		"control.tar.gz": func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+		"control.tar.xz": func(w io.Writer) io.WriteCloser {
+			xzw, _ := xz.NewWriter(w)
+			return xzw
+		},
+		"control.tar.zst": func(w io.Writer) io.WriteCloser {
+			zw, _ := zstd.NewWriter(w)
+			return zw
+		},
+		"control.tar": func(w io.Writer) io.WriteCloser { return nopWriteCloser{w} },
+	}
+
+	for member, compressor := range compressors {
+		ipk := mockIpk(t, member, compressor)
+		control, err := extractControlFromIpk(bytes.NewReader(ipk))
+		if err != nil {
+			t.Fatalf("extractControlFromIpk(%q): %v", member, err)
+		}
+		if control != _TestControl {
+			t.Fatalf("extractControlFromIpk(%q): expected %q, got %q", member, _TestControl, control)
+		}
+	}
+}
+
+// mockIpk creates an in-memory .ipk with a 'member' containing
+// the 'control' file, compressed via 'compressor'
+func mockIpk(t *testing.T, member string, compressor func(io.Writer) io.WriteCloser) []byte {
+	return mockIpkControl(t, member, compressor, _TestControl)
+}
+
+// mockIpkControl is mockIpk with the given 'control'
+func mockIpkControl(t *testing.T, member string, compressor func(io.Writer) io.WriteCloser, control string) []byte {
+
+	ctrlTar := bytes.NewBuffer(nil)
+	cw := compressor(ctrlTar)
+	tw := tar.NewWriter(cw)
+	tw.WriteHeader(&tar.Header{Name: "./control", Mode: 0644, Size: int64(len(control))})
+	io.WriteString(tw, control)
+	tw.Close()
+	cw.Close()
+
+	ipk := bytes.NewBuffer(nil)
+	aw := ar.NewWriter(ipk)
+	if err := aw.WriteGlobalHeader(); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range []struct {
+		name string
+		data []byte
+	}{
+		{"debian-binary", []byte("2.0\n")},
+		{member, ctrlTar.Bytes()},
+	} {
+		hdr := &ar.Header{Name: m.name, ModTime: time.Now(), Mode: 0644, Size: int64(len(m.data))}
+		if err := aw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		aw.Write(m.data)
+	}
+	return ipk.Bytes()
+}
@@ -18,6 +18,7 @@ package main
 // * opkg-make-index from the opkg-utils collection
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"log"
@@ -25,6 +26,8 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 )
 
 const versionString = "kellner-0.6.0"
@@ -32,9 +35,15 @@ const versionString = "kellner-0.6.0"
 func main() {
 
 	var (
+		configFile  = flag.String("config", "", "TOML file with settings (named like the flags) and per-directory settings. flags override the file")
+		checkConfig = flag.Bool("check-config", false, "validate the configuration, print the effective configuration and exit")
+
 		dumpPackageList = flag.Bool("dump", false,
 			"just dump the package list and exit")
 		prepareCache = flag.Bool("prep-cache", false, "scan all packages and prepare the cache folder, do not serve anything")
+		check        = flag.Bool("check", false, "just check the dependencies of all packages and exit")
+		checkDeps    = flag.Bool("check-deps", false, "check the dependencies of each directory and write "+_CheckReportName)
+		checkSibling = flag.Bool("check-siblings", false, "resolve dependencies also across sibling directories")
 
 		bind        = flag.String("bind", ":8080", "address to bind to")
 		rootName    = flag.String("root", "", "directory containing the packages")
@@ -42,18 +51,39 @@ func main() {
 		nworkers    = flag.Int("workers", 4, "number of workers")
 		addMd5      = flag.Bool("md5", true, "calculate md5 of scanned packages")
 		addSha1     = flag.Bool("sha1", false, "calculate sha1 of scanned packages")
+		addSha256   = flag.Bool("sha256", false, "calculate sha256 of scanned packages (always done for .deb)")
 		useGzip     = flag.Bool("gzip", true, "use 'gzip' to compress the package index. if false: use golang")
+		signKey     = flag.String("sign-key", "", "usign/signify ed25519 secret key to create Packages.sig")
+		gpgKey      = flag.String("gpg-key", "", "armored OpenPGP private key to create Release.gpg and InRelease")
 		showVersion = flag.Bool("version", false, "show version and exit")
 		logFileName = flag.String("log", "", "log to given filename")
+		gc          = flag.Bool("gc", false, "remove superseded package versions below -root (see -gc-keep, -gc-keep-age) and exit")
+		gcKeep      = flag.Int("gc-keep", 3, "-gc: keep the newest N versions per package and architecture")
+		gcKeepAge   = flag.Duration("gc-keep-age", 0, "-gc: keep all versions younger than the given age")
+		gcTrash     = flag.String("gc-trash", "", "-gc: move removed packages into this directory instead of deleting them")
+		gcDryRun    = flag.Bool("gc-dry-run", false, "-gc: just list the packages which would be removed")
+		gcInterval  = flag.Duration("gc-interval", 0, "run the garbage collection periodically while serving")
+		watch       = flag.Bool("watch", false, "watch -root via inotify and rescan changed directories")
+		watchDelay  = flag.Duration("watch-delay", 2*time.Second, "rescan a watched directory after no change happened for the given time")
 
 		tlsKey               = flag.String("tls-key", "", "PEM encoded ssl-key")
 		tlsCert              = flag.String("tls-cert", "", "PEM encoded ssl-cert")
 		tlsClientCas         = flag.String("tls-client-ca-file", "", "file with PEM encoded list of ssl-certs containing the CAs")
+		tlsCRLs              = flag.String("tls-crl", "", "comma separated list of files with PEM or DER encoded CRLs to check the client-certs against")
+		tlsProfile           = flag.String("tls-profile", "intermediate", "tls settings: "+strings.Join(tlsProfileNames(), ", ")+" (see README)")
+		tlsHTTP2             = flag.Bool("tls-http2", false, "offer HTTP/2 to tls clients")
 		tlsRequireClientCert = flag.Bool("require-client-cert", false, "require a client-cert")
-		tlsClientIDMuxRoot   = flag.String("idmap", "", "directory containing the client-mappings")
-		printClientCert      = flag.String("print-client-cert-id", "", "print client-id for given .cert and exit")
+		tlsClientIDMuxRoot   = flag.String("idmap", "", "directory containing the client-mappings or .json file with the client-mappings")
+		exportIDMap          = flag.String("idmap-export", "", "print the client-mappings of the given directory as .json and exit")
+		printClientCert      = flag.String("print-client-cert-id", "", "print all candidates for the client-id of the given .cert and exit")
+		clientIDSource       = flag.String("client-id", "subject", "source of the client-id: subject, subject-full, san-dns, san-email, san-ip, san-uri, sha256-cert or sha256-pubkey")
+		uploadClients        = flag.String("upload-clients", "", "file with client-ids (one per line) allowed to upload packages via PUT/POST")
+		uploadMaxSize        = flag.Int64("upload-max-size", 4<<30, "maximum size in bytes of an uploaded package or archive")
+		authTokens           = flag.String("auth-tokens", "", "file with bearer tokens and their client-ids (\"<token> <client-id>\" per line)")
+		authHtpasswd         = flag.String("auth-htpasswd", "", "htpasswd file with bcrypt hashed basic credentials (\"<user>:<hash>[:<client-id>]\" per line)")
 
 		condense    = flag.String("condense", "", "condense packages. argument is the target. (\"-\" is stdout and will just list filenames)")
+		condenseFor = flag.String("condense-packages", "", "comma separated list of packages: -condense only these and their dependencies")
 		vcomp       = flag.Bool("vcomp", false, "compare the first two non-flag arguments as versions")
 		archsubdirs = flag.Bool("archsubdirs", true, "create a subdir per arch when bundling packages")
 
@@ -63,13 +93,32 @@ func main() {
 
 	flag.Parse()
 
+	var config *kellnerConfig
+	if *configFile != "" {
+		if config, err = loadConfig(*configFile, flag.CommandLine); err == nil {
+			err = config.applyTo(flag.CommandLine)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: loading -config: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
 	if *showVersion {
 		fmt.Println(versionString)
 		return
 	}
 
 	if *printClientCert != "" {
-		if err = printClientIDTo(os.Stdout, *printClientCert); err != nil {
+		if err = printClientIDTo(os.Stdout, *printClientCert, *clientIDSource); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *exportIDMap != "" {
+		if err = exportIDMapDir(os.Stdout, *exportIDMap); err != nil {
 			fmt.Fprintf(os.Stderr, "error: %v\n", err)
 			os.Exit(1)
 		}
@@ -81,13 +130,79 @@ func main() {
 		os.Exit(1)
 	}
 
+	clientID, err := clientIDFuncByName(*clientIDSource)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "usage error: -client-id: %v\n", err)
+		os.Exit(1)
+	}
+
+	var auth = &clientAuth{ClientID: clientID}
+	if err = auth.Load(*authTokens, *authHtpasswd); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	if (*authTokens != "" || *authHtpasswd != "") && *tlsRequireClientCert {
+		fmt.Fprintf(os.Stderr, "usage error: -require-client-cert rejects the clients using -auth-tokens or -auth-htpasswd\n")
+		os.Exit(1)
+	}
+	if (*authTokens != "" || *authHtpasswd != "") && *tlsCert == "" {
+		log.Printf("warning: -auth-tokens and -auth-htpasswd without tls send the credentials in clear text")
+	}
+
+	gzipper := gzWrite(gzGzipPipe)
+	if !*useGzip {
+		gzipper = gzGolang
+	}
+
+	var scanOpts = scanOptions{
+		nworkers: *nworkers,
+		doMD5:    *addMd5,
+		doSHA1:   *addSha1,
+		doSHA256: *addSha256,
+		gzipper:  gzipper,
+
+		checkDeps:     *checkDeps,
+		checkSiblings: *checkSibling,
+	}
+
+	if *signKey != "" {
+		if scanOpts.usignKey, err = loadUsignKey(*signKey); err != nil {
+			fmt.Fprintf(os.Stderr, "error: loading -sign-key: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *gpgKey != "" {
+		if scanOpts.pgpKey, err = loadPGPKey(*gpgKey); err != nil {
+			fmt.Fprintf(os.Stderr, "error: loading -gpg-key: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if config != nil {
+		if err = config.setupDirs(&scanOpts, *signKey, *gpgKey); err != nil {
+			fmt.Fprintf(os.Stderr, "error: -config: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *checkConfig {
+		printConfigTo(os.Stdout, flag.CommandLine, &scanOpts)
+		return
+	}
+
 	if *condense != "" {
 		var (
 			err        error
 			condensate *packageIndex
 		)
-		if condensate, err = condensePackages(flag.Args(), *nworkers); err == nil {
-			if err = condensate.writeBundle(*condense, *archsubdirs); err == nil {
+		if *condenseFor != "" {
+			condensate, err = condenseClosure(flag.Args(), splitList(*condenseFor), &scanOpts)
+		} else {
+			condensate, err = condensePackages(flag.Args(), &scanOpts)
+		}
+		if err == nil {
+			if err = condensate.writeBundle(*condense, *archsubdirs, &scanOpts); err == nil {
 				os.Exit(0)
 			}
 		}
@@ -119,7 +234,19 @@ func main() {
 	// simple use-case: scan one directory and dump the created
 	// packages-list to stdout.
 	if *dumpPackageList {
-		dumpPackages(*rootName, *nworkers, *addMd5, *addSha1)
+		dumpPackages(*rootName, *nworkers, *addMd5, *addSha1, *addSha256)
+		return
+	}
+
+	if *check {
+		var cache string
+		if *cacheName != "" {
+			cache, _ = filepath.Abs(*cacheName)
+		}
+		if nerrors := checkPackages(*rootName, cache, *nworkers, *checkSibling); nerrors > 0 {
+			log.Printf("found %d broken dependencies", nerrors)
+			os.Exit(1)
+		}
 		return
 	}
 
@@ -134,12 +261,25 @@ func main() {
 		os.Exit(1)
 	}
 
-	gzipper := gzWrite(gzGzipPipe)
-	if !*useGzip {
-		gzipper = gzGolang
+	var gcOpts = gcPolicy{
+		keep:   *gcKeep,
+		maxAge: *gcKeepAge,
+		dryRun: *gcDryRun,
+	}
+	if *gcTrash != "" {
+		gcOpts.trash, _ = filepath.Abs(*gcTrash)
+	}
+	if (*gc || *gcInterval > 0) && gcOpts.keep < 1 {
+		fmt.Fprintf(os.Stderr, "usage error: -gc-keep must be at least 1\n")
+		os.Exit(1)
+	}
+
+	if *gc {
+		gcTree(*rootName, *cacheName, &gcOpts, &scanOpts)
+		return
 	}
 
-	scanRoot(*rootName, *cacheName, *nworkers, *addMd5, *addSha1, gzipper)
+	scanRoot(*rootName, *cacheName, &scanOpts)
 
 	if *prepareCache {
 		return
@@ -156,23 +296,50 @@ func main() {
 	}
 	listen = l
 
-	if *tlsCert != "" || *tlsKey != "" {
-
-		var tlsOpts = tlsOptions{
+	// everything which is reloaded on SIGHUP
+	var reload = reloadable{
+		configFile:   *configFile,
+		config:       config,
+		auth:         auth,
+		authTokens:   *authTokens,
+		authHtpasswd: *authHtpasswd,
+		tlsOpts: tlsOptions{
 			keyFileName:       *tlsKey,
 			certFileName:      *tlsCert,
 			requireClientCert: *tlsRequireClientCert,
+			askClientCert:     *uploadClients != "" || *tlsClientIDMuxRoot != "" || *authTokens != "" || *authHtpasswd != "",
 			clientCasFileName: *tlsClientCas,
-		}
+			crlFileNames:      splitList(*tlsCRLs),
+			clientID:          clientID,
+			profile:           *tlsProfile,
+			http2:             *tlsHTTP2,
+		},
+	}
+
+	if *tlsCert != "" || *tlsKey != "" {
 
-		if listen, err = initTLS(listen, &tlsOpts); err != nil {
+		if listen, reload.tls, err = initTLS(listen, &reload.tlsOpts); err != nil {
 
 			fmt.Fprintf(os.Stderr, "error: %v\n", err)
 			os.Exit(2)
 		}
+		go reload.tls.watchCRLs(_CRLCheckInterval)
 	}
 
-	go rescan(*rootName, *cacheName, *nworkers, *addMd5, *addSha1, gzipper)
+	go rescan(*rootName, *cacheName, &scanOpts)
+
+	if *gcInterval > 0 {
+		go gcPeriodically(*rootName, *cacheName, &gcOpts, &scanOpts, *gcInterval)
+	}
+
+	if *watch {
+		go func() {
+			watcher := newDirWatcher(*rootName, *cacheName, &scanOpts, *watchDelay)
+			if err := watcher.watch(); err != nil {
+				log.Printf("error: -watch: %v", err)
+			}
+		}()
+	}
 
 	log.Println("listen on", listen.Addr())
 
@@ -183,13 +350,42 @@ func main() {
 
 	var httpHandler http.Handler = rootMuxer
 	if *tlsClientIDMuxRoot != "" {
-		httpHandler = &clientIDMuxer{
-			Folder: *tlsClientIDMuxRoot,
-			Muxer:  rootMuxer,
+		var mapping idMapping
+		if mapping, err = newIDMapping(*tlsClientIDMuxRoot); err != nil {
+			fmt.Fprintf(os.Stderr, "error: loading -idmap: %v\n", err)
+			os.Exit(1)
 		}
+		reload.idmapName = *tlsClientIDMuxRoot
+		reload.idmap = &clientIDMuxer{
+			Root:    *rootName,
+			Cache:   *cacheName,
+			Mapping: mapping,
+			Muxer:   rootMuxer,
+			Auth:    auth,
+		}
+		httpHandler = reload.idmap
 	}
 
-	httpHandler = logRequests(httpHandler)
+	if *uploadClients != "" {
+		var clients []string
+		if clients, err = loadClientIDs(*uploadClients); err != nil {
+			fmt.Fprintf(os.Stderr, "error: loading -upload-clients: %v\n", err)
+			os.Exit(1)
+		}
+		httpHandler = &uploadHandler{
+			Root:    *rootName,
+			Cache:   *cacheName,
+			Opts:    &scanOpts,
+			Clients: clients,
+			MaxSize: *uploadMaxSize,
+			Auth:    auth,
+			Next:    httpHandler,
+		}
+	}
+
+	httpHandler = logRequests(httpHandler, clientID)
+
+	go reloadOnSIGHUP(&reload)
 
 	log.Println()
 	proto := "http://"
@@ -197,5 +393,21 @@ func main() {
 		proto = "https://"
 	}
 	log.Printf("serving at %s", proto+listen.Addr().String())
-	http.Serve(listen, httpHandler)
+	var server = &http.Server{Handler: httpHandler}
+	if !*tlsHTTP2 {
+		// a non-nil, empty TLSNextProto disables HTTP/2
+		server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
+	server.Serve(listen)
+}
+
+// splitList splits a comma separated list, empty entries are dropped
+func splitList(list string) []string {
+	var entries []string
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
 }
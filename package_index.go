@@ -9,10 +9,12 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
 	"io"
 	"sort"
+	"strings"
 	"sync"
 )
 
@@ -35,11 +37,14 @@ func (pi *packageIndex) StringTo(w io.Writer) {
 }
 
 // StampsTo writes all timestamps to write 'w'
-func (pi *packageIndex) StampsTo(w io.Writer) {
+func (pi *packageIndex) StampsTo(w io.Writer) error {
 	for _, name := range pi.SortedNames() {
 		entry := pi.Entries[name]
-		fmt.Fprintf(w, "%d %s\n", entry.FileInfo.ModTime().Unix(), name)
+		if _, err := fmt.Fprintf(w, "%d %s\n", entry.FileInfo.ModTime().Unix(), name); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
 func (pi *packageIndex) String() string {
@@ -62,3 +67,46 @@ func (pi *packageIndex) Add(name string, ipk *ipkArchive) {
 	pi.Entries[name] = ipk
 	pi.Unlock()
 }
+
+// readPackageIndex parses a 'Packages' file as created by StringTo().
+// the entries only carry Control, Header and Name (taken from
+// the "Filename" field).
+func readPackageIndex(r io.Reader) (*packageIndex, error) {
+
+	var (
+		pi      = &packageIndex{Entries: make(map[string]*ipkArchive)}
+		scanner = bufio.NewScanner(r)
+		stanza  = bytes.NewBuffer(nil)
+	)
+
+	addStanza := func() error {
+		if stanza.Len() == 0 {
+			return nil
+		}
+		var ipk = &ipkArchive{Control: stanza.String(), Header: make(map[string]string)}
+		stanza.Reset()
+		if err := ipk.ControlToHeader(ipk.Control); err != nil {
+			return err
+		}
+		ipk.Name = ipk.Header["Filename"]
+		pi.Entries[ipk.Name] = ipk
+		return nil
+	}
+
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.TrimSpace(line) != "" {
+			fmt.Fprintln(stanza, line)
+			continue
+		}
+		if err := addStanza(); err != nil {
+			return nil, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := addStanza(); err != nil {
+		return nil, err
+	}
+	return pi, nil
+}
@@ -9,61 +9,300 @@
 package main
 
 import (
+	"archive/tar"
 	"archive/zip"
+	"bytes"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 )
 
-// write a bundle of all packages in the index
-// a bundle can be a zip-archive/tar-archive/text-file
-// (currently implemented: zip-archive and primitive
-// list to stdout)
-func (self *packageIndex) writeBundle(output string, archsubdirs bool) error {
+// write a bundle of all packages in the index. a bundle is either
+// a zip-archive, a tar-archive (.tar, .tar.gz, .tgz, .tar.xz, .tar.zst),
+// a directory (existing or 'output' ends in "/") or a primitive list
+// to stdout ("-").
+//
+// next to the packages each (arch-)directory of the bundle gets
+// a 'Packages' and 'Packages.gz' file (and 'Packages.sig' if
+// opts.usignKey is set): the bundle is usable as a feed right away.
+func (self *packageIndex) writeBundle(output string, archsubdirs bool, opts *scanOptions) error {
 	now := time.Now()
-	// now let us create a zipfile with the condensated files
 	if output == "-" {
 		// this is more a debugging thing,
 		// output filenames to stdout
 		fmt.Printf("sorted names:\n%s\n", strings.Join(self.SortedNames(), "\n"))
-	} else if strings.HasSuffix(output, ".zip") {
-		zipfile, err := os.Create(output)
-		if err != nil {
-			return err
+		return nil
+	}
+
+	bundle, err := newBundleWriter(output)
+	if err != nil {
+		return err
+	}
+
+	// group the packages per directory of the bundle
+	var dirs = make(map[string]*packageIndex)
+	for _, pkg := range self.Entries {
+		dir := ""
+		if archsubdirs {
+			dir = pkg.Header["Architecture"]
 		}
-		defer zipfile.Close()
-
-		zipper := zip.NewWriter(zipfile)
-		defer zipper.Close()
-
-		for _, pkg := range self.Entries {
-			header := &zip.FileHeader{Name: pkg.Name}
-			if archsubdirs {
-				header.Name = filepath.Join(pkg.Header["Architecture"], header.Name)
-			}
-			header.SetModTime(now)
-			writer, zwerr := zipper.CreateHeader(header)
-			if zwerr != nil {
-				return zwerr
-			}
-			// read scanned package from original location
-			sourcepkg, srcerr := os.Open(pkg.ScanLocation)
-			if srcerr != nil {
-				return srcerr
-			}
-			// and write bytes into the zip/bundle
-			_, cperr := io.Copy(writer, sourcepkg)
-			sourcepkg.Close()
-			if cperr != nil {
-				return cperr
-			}
+		if dirs[dir] == nil {
+			dirs[dir] = &packageIndex{Entries: make(map[string]*ipkArchive)}
 		}
+		dirs[dir].Add(pkg.Name, pkg)
 	}
+
+	for _, dir := range sortedDirs(dirs) {
+		if err = writeBundleDir(bundle, dir, dirs[dir], now, opts); err != nil {
+			bundle.Abort()
+			return err
+		}
+	}
+	if err = bundle.Close(); err != nil {
+		bundle.Abort()
+		return err
+	}
+
 	log.Printf("wrote %d into archive: %s. done after %s\n",
 		self.Len(), output, time.Since(now))
 	return nil
 }
+
+// writeBundleDir writes the packages of 'pi' and their index files
+// into the directory 'dir' of 'bundle'
+func writeBundleDir(bundle bundleWriter, dir string, pi *packageIndex, now time.Time, opts *scanOptions) error {
+
+	for _, name := range pi.SortedNames() {
+		var pkg = pi.Entries[name]
+
+		// read scanned package from original location
+		sourcepkg, err := os.Open(pkg.ScanLocation)
+		if err != nil {
+			return err
+		}
+		// and write bytes into the bundle
+		err = bundle.WriteFile(path.Join(dir, name), pkg.FileInfo.Size(), now, sourcepkg)
+		sourcepkg.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	var (
+		index     = pi.String()
+		indexGz   = bytes.NewBuffer(nil)
+		indexName = path.Join(dir, "Packages")
+	)
+	if err := opts.gzipper(indexGz, strings.NewReader(index)); err != nil {
+		return fmt.Errorf("compressing %s: %v", indexName, err)
+	}
+
+	writeIndexFile := func(name string, content []byte) error {
+		return bundle.WriteFile(name, int64(len(content)), now, bytes.NewReader(content))
+	}
+
+	if err := writeIndexFile(indexName, []byte(index)); err != nil {
+		return err
+	}
+	if err := writeIndexFile(indexName+".gz", indexGz.Bytes()); err != nil {
+		return err
+	}
+	if opts.usignKey != nil {
+		var sig = bytes.NewBuffer(nil)
+		if err := opts.usignKey.SignatureTo(sig, []byte(index)); err != nil {
+			return fmt.Errorf("signing %s: %v", indexName, err)
+		}
+		if err := writeIndexFile(indexName+".sig", sig.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sortedDirs(dirs map[string]*packageIndex) []string {
+	var names = make([]string, 0, len(dirs))
+	for name := range dirs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// bundleWriter receives the files of a bundle. 'name' is always
+// slash-separated and relative to the root of the bundle. Abort()
+// removes a half-written archive, the files written into a directory
+// are left in place.
+type bundleWriter interface {
+	WriteFile(name string, size int64, modTime time.Time, r io.Reader) error
+	Close() error
+	Abort()
+}
+
+// newBundleWriter picks the bundleWriter based upon the suffix
+// of 'output'
+func newBundleWriter(output string) (bundleWriter, error) {
+
+	if strings.HasSuffix(output, "/") {
+		return &dirBundle{dir: output}, nil
+	}
+	if fi, err := os.Stat(output); err == nil && fi.IsDir() {
+		return &dirBundle{dir: output}, nil
+	}
+
+	var isTar bool
+	for _, suffix := range []string{".tar", ".tar.gz", ".tgz", ".tar.xz", ".tar.zst"} {
+		isTar = isTar || strings.HasSuffix(output, suffix)
+	}
+
+	if !isTar && !strings.HasSuffix(output, ".zip") {
+		return nil, fmt.Errorf("unsupported bundle target %q (use .zip, .tar, .tar.gz, .tgz, .tar.xz, .tar.zst or a directory/)", output)
+	}
+
+	file, err := os.Create(output)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isTar {
+		return &zipBundle{file: file, zw: zip.NewWriter(file)}, nil
+	}
+
+	var name = output
+	if strings.HasSuffix(name, ".tgz") {
+		name = strings.TrimSuffix(name, ".tgz") + ".tar.gz"
+	}
+	cw, err := compressWriter(name, file)
+	if err != nil {
+		file.Close()
+		os.Remove(output)
+		return nil, err
+	}
+	return &tarBundle{file: file, cw: cw, tw: tar.NewWriter(cw)}, nil
+}
+
+type zipBundle struct {
+	file *os.File
+	zw   *zip.Writer
+}
+
+func (zb *zipBundle) WriteFile(name string, size int64, modTime time.Time, r io.Reader) error {
+	header := &zip.FileHeader{Name: name}
+	header.SetModTime(modTime)
+	writer, err := zb.zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(writer, r)
+	return err
+}
+
+func (zb *zipBundle) Close() error {
+	err := zb.zw.Close()
+	if cerr := zb.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (zb *zipBundle) Abort() {
+	zb.file.Close()
+	os.Remove(zb.file.Name())
+}
+
+type tarBundle struct {
+	file *os.File
+	cw   io.WriteCloser // compressing writer
+	tw   *tar.Writer
+}
+
+func (tb *tarBundle) WriteFile(name string, size int64, modTime time.Time, r io.Reader) error {
+	header := &tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     size,
+		ModTime:  modTime,
+		Typeflag: tar.TypeReg,
+	}
+	if err := tb.tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := io.Copy(tb.tw, r)
+	return err
+}
+
+func (tb *tarBundle) Close() error {
+	err := tb.tw.Close()
+	if cerr := tb.cw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := tb.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (tb *tarBundle) Abort() {
+	tb.file.Close()
+	os.Remove(tb.file.Name())
+}
+
+type dirBundle struct {
+	dir string
+}
+
+func (db *dirBundle) WriteFile(name string, size int64, modTime time.Time, r io.Reader) error {
+	var fileName = filepath.Join(db.dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+		return err
+	}
+	file, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(file, r); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(fileName, modTime, modTime)
+}
+
+func (db *dirBundle) Close() error { return nil }
+
+func (db *dirBundle) Abort() {}
+
+// addFileToTar writes the file 'fileName' as 'name' into 'tw'
+func addFileToTar(tw *tar.Writer, name, fileName string) error {
+
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	fi, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	header, err := tar.FileInfoHeader(fi, "")
+	if err != nil {
+		return err
+	}
+	header.Name = filepath.ToSlash(name)
+	header.Mode = 0644
+
+	if err = tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, file)
+	return err
+}
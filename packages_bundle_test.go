@@ -0,0 +1,207 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2016, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// every bundle format carries the packages and a Packages index
+// per architecture
+func TestWriteBundle(t *testing.T) {
+
+	tmp, err := ioutil.TempDir("", "kellner-bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		root = filepath.Join(tmp, "root")
+		gz   = func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }
+		opts = &scanOptions{gzipper: gzGolang}
+	)
+	os.MkdirAll(root, 0755)
+	for name, control := range map[string]string{
+		"foo_1.0_all.ipk":   "Package: foo\nVersion: 1.0\nArchitecture: all\n",
+		"bar_1.0_armv7.ipk": "Package: bar\nVersion: 1.0\nArchitecture: armv7\n",
+	} {
+		ipk := mockIpkControl(t, "control.tar.gz", gz, control)
+		if err = ioutil.WriteFile(filepath.Join(root, name), ipk, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	scanner := &packageScanner{doMD5: true}
+	if err = scanner.scan(root, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"all/Packages", "all/Packages.gz", "all/foo_1.0_all.ipk",
+		"armv7/Packages", "armv7/Packages.gz", "armv7/bar_1.0_armv7.ipk",
+	}
+
+	for _, suffix := range []string{".tar", ".tar.gz", ".tgz", ".tar.xz", ".tar.zst", ".zip", "-dir/"} {
+		// filepath.Join() would strip the "/" of the directory
+		output := filepath.Join(tmp, "bundle") + suffix
+		if err = scanner.packages.writeBundle(output, true, opts); err != nil {
+			t.Errorf("%s: %v", suffix, err)
+			continue
+		}
+
+		files := readBundle(t, output)
+		var names []string
+		for name := range files {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if !reflect.DeepEqual(names, expected) {
+			t.Errorf("%s: expected %v, got %v", suffix, expected, names)
+			continue
+		}
+
+		for arch, pkg := range map[string]string{"all": "foo", "armv7": "bar"} {
+			index := files[arch+"/Packages"]
+			if !strings.Contains(index, "Package: "+pkg+"\n") || strings.Count(index, "Package: ") != 1 {
+				t.Errorf("%s: expected only %q in %s/Packages, got\n%s", suffix, pkg, arch, index)
+			}
+		}
+	}
+}
+
+// an unknown suffix is refused and a failed bundle leaves no
+// partial archive behind
+func TestWriteBundleFails(t *testing.T) {
+
+	tmp, err := ioutil.TempDir("", "kellner-bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		root = filepath.Join(tmp, "root")
+		gz   = func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }
+		opts = &scanOptions{gzipper: gzGolang}
+	)
+	os.MkdirAll(root, 0755)
+	for _, name := range []string{"bar_1.0_all.ipk", "foo_1.0_all.ipk"} {
+		if err = ioutil.WriteFile(filepath.Join(root, name), mockIpk(t, "control.tar.gz", gz), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	scanner := &packageScanner{doMD5: true}
+	if err = scanner.scan(root, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	output := filepath.Join(tmp, "bundle.tar.lz4")
+	if err = scanner.packages.writeBundle(output, false, opts); err == nil {
+		t.Errorf("expected an error for %q", output)
+	}
+	if _, err = os.Stat(output); !os.IsNotExist(err) {
+		t.Errorf("expected no %q, got %v", output, err)
+	}
+
+	// "bar" makes it into the bundle, "foo" is gone
+	os.Remove(filepath.Join(root, "foo_1.0_all.ipk"))
+	for _, suffix := range []string{".tar.gz", ".zip"} {
+		output = filepath.Join(tmp, "bundle"+suffix)
+		if err = scanner.packages.writeBundle(output, false, opts); err == nil {
+			t.Errorf("%s: expected an error for the missing package", suffix)
+		}
+		if _, err = os.Stat(output); !os.IsNotExist(err) {
+			t.Errorf("%s: expected the partial bundle to be removed, got %v", suffix, err)
+		}
+	}
+}
+
+// readBundle returns the content of all files in the bundle 'output'
+func readBundle(t *testing.T, output string) map[string]string {
+
+	var files = make(map[string]string)
+
+	switch {
+	case strings.HasSuffix(output, "/"):
+		err := filepath.Walk(output, func(fileName string, fi os.FileInfo, err error) error {
+			if err != nil || fi.IsDir() {
+				return err
+			}
+			content, err := ioutil.ReadFile(fileName)
+			if err != nil {
+				return err
+			}
+			name, _ := filepath.Rel(output, fileName)
+			files[filepath.ToSlash(name)] = string(content)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+	case strings.HasSuffix(output, ".zip"):
+		zr, err := zip.OpenReader(output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer zr.Close()
+		for _, f := range zr.File {
+			r, err := f.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			content, err := ioutil.ReadAll(r)
+			r.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			files[f.Name] = string(content)
+		}
+
+	default:
+		file, err := os.Open(output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		r, err := decompressReader(strings.Replace(output, ".tgz", ".tar.gz", 1), file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		tr := tar.NewReader(r)
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			content, err := ioutil.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			files[header.Name] = string(content)
+		}
+	}
+	return files
+}
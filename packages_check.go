@@ -0,0 +1,167 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2016, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// name of the dependency report, created per directory next to
+// the 'Packages' file
+const _CheckReportName = "Packages.check.json"
+
+type depReport struct {
+	Directory string
+	Date      time.Time
+	Packages  int
+	Problems  []depProblem
+}
+
+// checkDir validates the dependencies of 'packages' (found in 'path'),
+// logs the problems and writes the report into 'cachePath'. if
+// 'siblings' is set, packages of the sibling directories (read from
+// their cached 'Packages' files) might satisfy dependencies as well.
+func checkDir(root, cache, path string, packages *packageIndex, siblings bool) error {
+
+	var indices = []*packageIndex{packages}
+	if siblings {
+		indices = append(indices, cachedSiblingIndices(root, cache, path)...)
+	}
+
+	var (
+		relPath, _   = filepath.Rel(root, path)
+		cachePath, _ = filepath.Abs(filepath.Join(cache, relPath))
+		report       = depReport{
+			Directory: "/" + filepath.ToSlash(relPath),
+			Date:      time.Now(),
+			Packages:  packages.Len(),
+			Problems:  newDepUniverse(indices...).check(packages),
+		}
+	)
+	if relPath == "." {
+		report.Directory = "/"
+	}
+
+	for _, problem := range report.Problems {
+		log.Printf("%s: broken dependency in %q: %s", problem.Severity, path, problem)
+	}
+
+	content, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(cachePath, _CheckReportName)
+	if err != nil {
+		return fmt.Errorf("can't create the %s file in %q: %v", _CheckReportName, cachePath, err)
+	}
+	defer tmp.Close()
+	if _, err = tmp.Write(content); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	tmp.Sync()
+	return os.Rename(tmp.Name(), filepath.Join(cachePath, _CheckReportName))
+}
+
+// cachedSiblingIndices reads the cached 'Packages' of all directories
+// next to 'path'
+func cachedSiblingIndices(root, cache, path string) []*packageIndex {
+
+	if path == root {
+		return nil
+	}
+
+	var parent = filepath.Dir(path)
+	var entries, err = ioutil.ReadDir(parent)
+	if err != nil {
+		return nil
+	}
+
+	var indices []*packageIndex
+	for _, entry := range entries {
+		var sibling = filepath.Join(parent, entry.Name())
+		if !entry.IsDir() || sibling == path || isSubPath(sibling, cache) {
+			continue
+		}
+		var relPath, _ = filepath.Rel(root, sibling)
+		file, err := os.Open(filepath.Join(cache, relPath, "Packages"))
+		if err != nil {
+			continue
+		}
+		pi, err := readPackageIndex(file)
+		file.Close()
+		if err != nil {
+			log.Printf("warning: reading index of %q: %v", sibling, err)
+			continue
+		}
+		indices = append(indices, pi)
+	}
+	return indices
+}
+
+// checkPackages implements -check: scan all directories below 'root'
+// (but not 'cache' and the directories of running imports) and print
+// the dependency problems of each directory to stdout. returns the
+// number of problems with severity "error".
+func checkPackages(root, cache string, nworkers int, siblings bool) int {
+
+	var (
+		indices = make(map[string]*packageIndex)
+		dirs    []string
+		nerrors int
+	)
+
+	filepath.Walk(root, func(path string, fi os.FileInfo, walkerr error) error {
+		if fi == nil {
+			log.Printf("no such file or directory: %s\n", path)
+			return nil
+		}
+		if !fi.IsDir() {
+			return nil
+		}
+		if (cache != "" && isSubPath(path, cache)) || isStagingName(fi.Name()) {
+			return filepath.SkipDir
+		}
+		var scanner = packageScanner{}
+		if err := scanner.scan(path, nworkers); err != nil {
+			log.Printf("error: %v", err)
+			return nil
+		}
+		indices[path] = scanner.packages
+		dirs = append(dirs, path)
+		return nil
+	})
+
+	sort.Strings(dirs)
+	for _, dir := range dirs {
+		var universe = []*packageIndex{indices[dir]}
+		if siblings && dir != root {
+			for _, other := range dirs {
+				if other != dir && filepath.Dir(other) == filepath.Dir(dir) {
+					universe = append(universe, indices[other])
+				}
+			}
+		}
+		for _, problem := range newDepUniverse(universe...).check(indices[dir]) {
+			fmt.Printf("%s: %s: %s\n", dir, problem.Severity, problem)
+			if problem.Severity == "error" {
+				nerrors++
+			}
+		}
+	}
+	return nerrors
+}
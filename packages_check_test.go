@@ -0,0 +1,86 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2016, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// "app" depends on "libfoo" which is available in the sibling "cache2"
+// only, next to the cache "cache"
+func TestCheckSiblings(t *testing.T) {
+
+	tmp, err := ioutil.TempDir("", "kellner-check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		root  = filepath.Join(tmp, "root")
+		cache = filepath.Join(root, "cache")
+		gz    = func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }
+	)
+	for name, control := range map[string]string{
+		"app/app_1.0_all.ipk":       "Package: app\nVersion: 1.0\nArchitecture: all\nDepends: libfoo (>= 1.0)\n",
+		"cache2/libfoo_1.0_all.ipk": "Package: libfoo\nVersion: 1.0\nArchitecture: all\n",
+	} {
+		fileName := filepath.Join(root, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(fileName), 0755)
+		if err = ioutil.WriteFile(fileName, mockIpkControl(t, "control.tar.gz", gz, control), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, siblings := range []bool{false, true} {
+
+		opts := &scanOptions{nworkers: 1, gzipper: gzGolang, checkDeps: true, checkSiblings: siblings}
+		for _, dir := range []string{"cache2", "app"} {
+			if err = scanDir(root, cache, filepath.Join(root, dir), opts); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		content, err := ioutil.ReadFile(filepath.Join(cache, "app", _CheckReportName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var report depReport
+		if err = json.Unmarshal(content, &report); err != nil {
+			t.Fatal(err)
+		}
+		if report.Directory != "/app" || report.Packages != 1 {
+			t.Errorf("siblings %v: unexpected report %s", siblings, content)
+		}
+
+		var nexpected = 1
+		if siblings {
+			nexpected = 0
+		}
+		if len(report.Problems) != nexpected {
+			t.Errorf("siblings %v: expected %d problems, got %s", siblings, nexpected, content)
+		} else if nexpected == 1 {
+			p := report.Problems[0]
+			if p.Package != "app" || p.Field != "Depends" || p.Relation != "libfoo (>= 1.0)" || p.Severity != "error" {
+				t.Errorf("siblings %v: unexpected problem %s", siblings, content)
+			}
+		}
+
+		// -check walks the tree on its own
+		if nerrors := checkPackages(root, cache, 1, siblings); nerrors != nexpected {
+			t.Errorf("siblings %v: -check: expected %d errors, got %d", siblings, nexpected, nerrors)
+		}
+	}
+}
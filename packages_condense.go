@@ -12,11 +12,11 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
-	"unicode"
 )
 
 // recursively scan through a list of directories and find
@@ -24,56 +24,33 @@ import (
 // most recent version.
 // the result/output is collected within a packageIndex
 // and returned.
-func condensePackages(roots []string, nworkers int) (*packageIndex, error) {
+func condensePackages(roots []string, opts *scanOptions) (*packageIndex, error) {
 	var (
-		scanner = packageScanner{
-			doMD5:  false,
-			doSHA1: false,
-		}
-		now = time.Now()
+		now           = time.Now()
+		packages, err = scanPackageDirs(roots, opts)
 	)
-	for _, root := range roots {
-		werr := filepath.Walk(root, func(path string, fi os.FileInfo, walkerr error) error {
-			if fi == nil {
-				log.Printf("no such file or directory: %s\n", path)
-				return nil
-			}
-			if !fi.IsDir() {
-				return nil
-			}
-			log.Println("condensing packages from", path)
-
-			if err := scanner.scan(path, nworkers); err != nil {
-				return fmt.Errorf("error: %v\n", err)
-			}
-			return nil
-		})
-		if werr != nil {
-			return nil, werr
-		}
-	}
-	if scanner.packages == nil {
-		log.Printf("no packages found.\n")
-		return nil, fmt.Errorf("no packages found.")
+	if err != nil {
+		return nil, err
 	}
 
 	// and now to the act of condensing...
-	log.Printf("condensing a set of %d packages\n", scanner.packages.Len())
+	log.Printf("condensing a set of %d packages\n", packages.Len())
 	condensate := &packageIndex{Entries: make(map[string]*ipkArchive)} // key is Package+Architecture
-	for pkgname, pkg := range scanner.packages.Entries {
+	for pkgname, pkg := range packages.Entries {
 
 		// slight paranoia check (control data ./. pkgname):
 		epochless_version := pkg.Header["Version"]
 		if idx := strings.Index(pkg.Header["Version"], ":"); idx > 0 {
 			epochless_version = pkg.Header["Version"][idx+1:]
 		}
-		synthetic_pkgname := fmt.Sprintf("%s_%s_%s.ipk",
-			pkg.Header["Package"], epochless_version, pkg.Header["Architecture"])
+		synthetic_pkgname := fmt.Sprintf("%s_%s_%s%s",
+			pkg.Header["Package"], epochless_version, pkg.Header["Architecture"],
+			path.Ext(pkgname))
 		if synthetic_pkgname != pkgname {
 			return nil, fmt.Errorf("package %s has mismatching control-information \"%s\"",
 				pkgname, synthetic_pkgname)
 		}
-		cname := pkg.Header["Architecture"] + pkg.Header["Package"] // condense-key
+		cname := condenseKey(pkg)
 		if prev, ok := condensate.Entries[cname]; ok {
 			// compare version
 			cmp := compareVersion(pkg.Header["Version"], prev.Header["Version"])
@@ -88,56 +65,188 @@ func condensePackages(roots []string, nworkers int) (*packageIndex, error) {
 		}
 	}
 	log.Printf("condensed %d into %d packages. done after %s\n",
-		scanner.packages.Len(), condensate.Len(), time.Since(now))
+		packages.Len(), condensate.Len(), time.Since(now))
 	return condensate, nil
 }
 
-// compare to versions,
-// return 0 when equal or 1/-1 when different
-func compareVersion(v1 string, v2 string) int {
-	v1ord := versionStringToOrdinals(v1)
-	v2ord := versionStringToOrdinals(v2)
+// condenseKey groups the versions of a package: packages with the
+// same key are different versions of the same package.
+func condenseKey(pkg *ipkArchive) string {
+	return pkg.Header["Architecture"] + pkg.Header["Package"]
+}
+
+// like condensePackages, but keep only the packages listed in 'names'
+// and all the packages they depend on (Pre-Depends and Depends). the
+// newest version satisfying all dependencies is picked.
+func condenseClosure(roots, names []string, opts *scanOptions) (*packageIndex, error) {
+	var (
+		now           = time.Now()
+		packages, err = scanPackageDirs(roots, opts)
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("resolving %d packages out of a set of %d packages\n", len(names), packages.Len())
+	closure, err := newDepUniverse(packages).closure(names)
+	if err != nil {
+		return nil, err
+	}
+
+	condensate := &packageIndex{Entries: make(map[string]*ipkArchive)}
+	for _, pkg := range closure {
+		condensate.Add(pkg.Name, pkg)
+	}
+	log.Printf("resolved %d into %d packages. done after %s\n",
+		len(names), condensate.Len(), time.Since(now))
+	return condensate, nil
+}
 
-	// make them equal in length, append zeros to the shorter one:
-	lendiff := len(v1ord) - len(v2ord)
-	if lendiff < 0 {
-		v1ord = append(v1ord, make([]int, (-1*lendiff))...)
-	} else if lendiff > 0 {
-		v2ord = append(v2ord, make([]int, (lendiff))...)
+// recursively scan through a list of directories and collect
+// all packages. the checksums are calculated as requested by 'opts'
+// since they end up in the index of the bundle.
+func scanPackageDirs(roots []string, opts *scanOptions) (*packageIndex, error) {
+	var scanner = packageScanner{
+		doMD5:    opts.doMD5,
+		doSHA1:   opts.doSHA1,
+		doSHA256: opts.doSHA256,
 	}
+	for _, root := range roots {
+		werr := filepath.Walk(root, func(path string, fi os.FileInfo, walkerr error) error {
+			if fi == nil {
+				log.Printf("no such file or directory: %s\n", path)
+				return nil
+			}
+			if !fi.IsDir() {
+				return nil
+			}
+			log.Println("condensing packages from", path)
 
-	for i := range v1ord {
-		if v1ord[i] < v2ord[i] {
+			if err := scanner.scan(path, opts.nworkers); err != nil {
+				return fmt.Errorf("error: %v\n", err)
+			}
+			return nil
+		})
+		if werr != nil {
+			return nil, werr
+		}
+	}
+	if scanner.packages == nil {
+		log.Printf("no packages found.\n")
+		return nil, fmt.Errorf("no packages found.")
+	}
+	return scanner.packages, nil
+}
+
+// compareVersion compares two package versions the way opkg and dpkg do
+// (see "Version" in
+// https://www.debian.org/doc/debian-policy/ch-controlfields.html):
+// "[epoch:]upstream[-revision]". the epochs are compared numerically,
+// upstream and revision are compared by verrevcmp().
+//
+// returns 0 when equal, 1 when v1 is newer, -1 when v2 is newer
+func compareVersion(v1 string, v2 string) int {
+	pv1, pv2 := parseVersion(v1), parseVersion(v2)
+
+	if pv1.epoch != pv2.epoch {
+		if pv1.epoch < pv2.epoch {
 			return -1
 		}
-		if v1ord[i] > v2ord[i] {
+		return 1
+	}
+	if rc := verrevcmp(pv1.upstream, pv2.upstream); rc != 0 {
+		return rc
+	}
+	return verrevcmp(pv1.revision, pv2.revision)
+}
+
+type pkgVersion struct {
+	epoch    int
+	upstream string
+	revision string
+}
+
+// parseVersion splits "[epoch:]upstream[-revision]" into its parts.
+// the upstream part might contain '-', the revision starts after
+// the last '-'.
+func parseVersion(version string) pkgVersion {
+	var pv pkgVersion
+
+	version = strings.TrimSpace(version)
+	if idx := strings.IndexByte(version, ':'); idx >= 0 {
+		pv.epoch, _ = strconv.Atoi(version[:idx])
+		version = version[idx+1:]
+	}
+	if idx := strings.LastIndexByte(version, '-'); idx >= 0 {
+		pv.revision = version[idx+1:]
+		version = version[:idx]
+	}
+	pv.upstream = version
+	return pv
+}
+
+// verrevcmp compares 'a' and 'b' alternating between non-digit and digit
+// parts. non-digit parts are compared char by char using versionCharOrder(),
+// digit parts are compared numerically.
+func verrevcmp(a, b string) int {
+	for a != "" || b != "" {
+		var firstDiff int
+
+		for (a != "" && !isDigit(a[0])) || (b != "" && !isDigit(b[0])) {
+			ac, bc := versionCharOrder(a), versionCharOrder(b)
+			if ac != bc {
+				return sign(ac - bc)
+			}
+			a, b = a[1:], b[1:]
+		}
+
+		a, b = strings.TrimLeft(a, "0"), strings.TrimLeft(b, "0")
+		for a != "" && isDigit(a[0]) && b != "" && isDigit(b[0]) {
+			if firstDiff == 0 {
+				firstDiff = int(a[0]) - int(b[0])
+			}
+			a, b = a[1:], b[1:]
+		}
+		if a != "" && isDigit(a[0]) {
 			return 1
 		}
+		if b != "" && isDigit(b[0]) {
+			return -1
+		}
+		if firstDiff != 0 {
+			return sign(firstDiff)
+		}
 	}
 	return 0
 }
 
-// convert a string into an array of numbers parsed from
-// all occurances of consecutive digits
-// "foo123bar321" --> [123, 321]
-// "version-1.0.7-rc3.3" --> [1,0,7,3,3]
-func versionStringToOrdinals(version_string string) []int {
-	ord := ""
-	ordarray := []int{}
-	addComponent := func() {
-		if len(ord) > 0 {
-			i, _ := strconv.Atoi(ord) // error is unlikely with all digits
-			ordarray = append(ordarray, i)
-			ord = ""
-		}
+// versionCharOrder returns the weight of the first char of 's':
+// '~' sorts before everything, even before the end of the string,
+// letters sort before all other non-digits.
+func versionCharOrder(s string) int {
+	if s == "" {
+		return 0
 	}
-	for _, c := range version_string {
-		if !unicode.IsDigit(c) {
-			addComponent()
-			continue
-		}
-		ord += string(c)
+	switch c := s[0]; {
+	case isDigit(c):
+		return 0
+	case ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z'):
+		return int(c)
+	case c == '~':
+		return -1
+	default:
+		return int(c) + 256
 	}
-	addComponent()
-	return ordarray
+}
+
+func isDigit(c byte) bool { return '0' <= c && c <= '9' }
+
+func sign(i int) int {
+	switch {
+	case i < 0:
+		return -1
+	case i > 0:
+		return 1
+	}
+	return 0
 }
@@ -0,0 +1,56 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2016, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import "testing"
+
+// reference results taken from 'dpkg --compare-versions'
+func TestCompareVersion(t *testing.T) {
+
+	samples := []struct {
+		v1, v2   string
+		expected int
+	}{
+		{"1.0", "1.0", 0},
+		{"0:1.0", "1.0", 0},
+		{"1.0~rc1", "1.0", -1},
+		{"1.0~~", "1.0~~a", -1},
+		{"1.0~~a", "1.0~", -1},
+		{"1.0~", "1.0", -1},
+		{"1.0", "1.0a", -1},
+		{"1.0a", "1.0b", -1},
+		{"1.0a", "1.0+", -1},
+		{"1.0", "1.0+b1", -1},
+		{"1.0-1", "1.0-2", -1},
+		{"1.0-1", "1.0-1.1", -1},
+		{"2:1.0", "1:9.0", 1},
+		{"1:1.0", "9.0", 1},
+		{"1.2.3", "1.2.10", -1},
+		{"1.0", "1.0.0", -1},
+		{"1.0", "1.0-0", 0},
+		{"001", "1", 0},
+		{"1.0-r0", "1.0-r1", -1},
+		{"1.0-r9", "1.0-r10", -1},
+		{"1.0-rc1-1", "1.0-1", 1},
+		{"2.30~git20160101", "2.30", -1},
+		{"1.0.0-r0.1", "1.0.0-r0", 1},
+		{"1.0~rc1~git", "1.0~rc1", -1},
+		{"0.9.9+git0+abc-r0", "0.9.9+git1+aaa-r0", -1},
+	}
+
+	for _, s := range samples {
+		if rc := compareVersion(s.v1, s.v2); rc != s.expected {
+			t.Errorf("compareVersion(%q, %q): expected %d, got %d", s.v1, s.v2, s.expected, rc)
+		}
+		// and the other way around
+		if rc := compareVersion(s.v2, s.v1); rc != -s.expected {
+			t.Errorf("compareVersion(%q, %q): expected %d, got %d", s.v2, s.v1, -s.expected, rc)
+		}
+	}
+}
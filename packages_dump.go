@@ -16,12 +16,13 @@ import (
 	"time"
 )
 
-func dumpPackages(root string, nworkers int, doMD5, doSHA1 bool) {
+func dumpPackages(root string, nworkers int, doMD5, doSHA1, doSHA256 bool) {
 
 	var (
 		scanner = packageScanner{
-			doMD5:  doMD5,
-			doSHA1: doSHA1,
+			doMD5:    doMD5,
+			doSHA1:   doSHA1,
+			doSHA256: doSHA256,
 		}
 		now = time.Now()
 	)
@@ -0,0 +1,74 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2016, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/clearsign"
+)
+
+// loadPGPKey reads the first private key from the armored keyring
+// 'fileName'. passphrase protected keys are not supported.
+func loadPGPKey(fileName string) (*openpgp.Entity, error) {
+
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entities, err := openpgp.ReadArmoredKeyRing(file)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %q: %v", fileName, err)
+	}
+
+	for _, entity := range entities {
+		if entity.PrivateKey == nil {
+			continue
+		}
+		if entity.PrivateKey.Encrypted {
+			return nil, fmt.Errorf("parsing %q: encrypted keys are not supported", fileName)
+		}
+		return entity, nil
+	}
+	return nil, fmt.Errorf("%q does not contain a private key", fileName)
+}
+
+// pgpDetachSignTo writes an armored, detached signature of 'msg' to 'w'
+// (eg. "Release.gpg")
+func pgpDetachSignTo(w io.Writer, key *openpgp.Entity, msg []byte) error {
+	if err := openpgp.ArmoredDetachSign(w, key, bytes.NewReader(msg), nil); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// pgpClearSignTo writes 'msg' as a clearsigned message to 'w'
+// (eg. "InRelease")
+func pgpClearSignTo(w io.Writer, key *openpgp.Entity, msg []byte) error {
+	plaintext, err := clearsign.Encode(w, key.PrivateKey, nil)
+	if err != nil {
+		return err
+	}
+	if _, err = plaintext.Write(msg); err != nil {
+		plaintext.Close()
+		return err
+	}
+	if err = plaintext.Close(); err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "\n")
+	return err
+}
@@ -0,0 +1,88 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2016, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/clearsign"
+)
+
+// scanDir signs 'Release': 'Release.gpg' and 'InRelease' must verify
+// against the public key
+func TestPGPSignedRelease(t *testing.T) {
+
+	tmp, err := ioutil.TempDir("", "kellner-pgp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		root  = filepath.Join(tmp, "root")
+		cache = filepath.Join(tmp, "cache")
+		gz    = func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }
+	)
+	os.MkdirAll(root, 0755)
+	if err = ioutil.WriteFile(filepath.Join(root, "foo_1.0-r0_all.ipk"), mockIpk(t, "control.tar.gz", gz), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := openpgp.NewEntity("kellner", "test", "kellner@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &scanOptions{nworkers: 1, gzipper: gzGolang, pgpKey: key}
+	if err = scanDir(root, cache, root, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	read := func(name string) []byte {
+		content, err := ioutil.ReadFile(filepath.Join(cache, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return content
+	}
+	var (
+		release   = read("Release")
+		keyring   = openpgp.EntityList{key}
+		inRelease = read("InRelease")
+	)
+
+	if _, err = openpgp.CheckArmoredDetachedSignature(keyring, bytes.NewReader(release), bytes.NewReader(read("Release.gpg"))); err != nil {
+		t.Errorf("Release.gpg: %v", err)
+	}
+
+	block, _ := clearsign.Decode(inRelease)
+	if block == nil {
+		t.Fatalf("InRelease: no clearsigned message")
+	}
+	if !bytes.Equal(bytes.TrimSpace(block.Plaintext), bytes.TrimSpace(release)) {
+		t.Errorf("InRelease: expected the content of Release, got\n%s", block.Plaintext)
+	}
+	if _, err = openpgp.CheckDetachedSignature(keyring, bytes.NewReader(block.Bytes), block.ArmoredSignature.Body); err != nil {
+		t.Errorf("InRelease: %v", err)
+	}
+
+	// no temp files are left behind
+	entries, _ := ioutil.ReadDir(cache)
+	for _, entry := range entries {
+		if !entry.IsDir() && !isIndexName(entry.Name()) && filepath.Ext(entry.Name()) != ".json" {
+			t.Errorf("unexpected file %q in the cache", entry.Name())
+		}
+	}
+}
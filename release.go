@@ -0,0 +1,114 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2016, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// releaseIndex is the 'Release' file of an apt "flat repository", see
+// https://wiki.debian.org/DebianRepository/Format#Flat_Repository_Format
+// it lists the index files of a directory together with their checksums.
+type releaseIndex struct {
+	Date          time.Time
+	Architectures []string
+	Files         []releaseEntry
+}
+
+type releaseEntry struct {
+	Name   string // name relative to the directory, eg. "Packages.gz"
+	Size   int64
+	Md5    string
+	Sha1   string
+	Sha256 string
+}
+
+func newRelease(pi *packageIndex) *releaseIndex {
+
+	var archs = make(map[string]bool)
+	for _, entry := range pi.Entries {
+		if arch := entry.Header["Architecture"]; arch != "" {
+			archs[arch] = true
+		}
+	}
+
+	var rel = &releaseIndex{Date: time.Now().UTC()}
+	for arch := range archs {
+		rel.Architectures = append(rel.Architectures, arch)
+	}
+	sort.Strings(rel.Architectures)
+	return rel
+}
+
+// AddFile adds the file 'fileName' as 'name' to the list of files
+// covered by the Release file. 'fileName' might be a temporary name,
+// 'name' is how clients will request the file.
+func (rel *releaseIndex) AddFile(name, fileName string) error {
+
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var (
+		md5er    = md5.New()
+		sha1er   = sha1.New()
+		sha256er = sha256.New()
+		n        int64
+	)
+	if n, err = io.Copy(io.MultiWriter(md5er, sha1er, sha256er), file); err != nil {
+		return fmt.Errorf("hashing %q: %v", fileName, err)
+	}
+
+	rel.Files = append(rel.Files, releaseEntry{
+		Name:   name,
+		Size:   n,
+		Md5:    hex.EncodeToString(md5er.Sum(nil)),
+		Sha1:   hex.EncodeToString(sha1er.Sum(nil)),
+		Sha256: hex.EncodeToString(sha256er.Sum(nil)),
+	})
+	return nil
+}
+
+// StringTo writes the Release file to 'w'
+func (rel *releaseIndex) StringTo(w io.Writer) {
+	fmt.Fprintf(w, "Date: %s\n", rel.Date.Format(time.RFC1123))
+	if len(rel.Architectures) > 0 {
+		fmt.Fprintf(w, "Architectures: %s\n", strings.Join(rel.Architectures, " "))
+	}
+	fmt.Fprintln(w, "MD5Sum:")
+	for _, f := range rel.Files {
+		fmt.Fprintf(w, " %s %16d %s\n", f.Md5, f.Size, f.Name)
+	}
+	fmt.Fprintln(w, "SHA1:")
+	for _, f := range rel.Files {
+		fmt.Fprintf(w, " %s %16d %s\n", f.Sha1, f.Size, f.Name)
+	}
+	fmt.Fprintln(w, "SHA256:")
+	for _, f := range rel.Files {
+		fmt.Fprintf(w, " %s %16d %s\n", f.Sha256, f.Size, f.Name)
+	}
+}
+
+func (rel *releaseIndex) String() string {
+	buf := bytes.NewBuffer(nil)
+	rel.StringTo(buf)
+	return buf.String()
+}
@@ -0,0 +1,165 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2016, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"strconv"
+	"syscall"
+)
+
+// reloadable collects what kellner reloads on SIGHUP: the -config file,
+// the tls credentials (-tls-cert, -tls-key, -tls-client-ca-file,
+// -require-client-cert), the -idmap folder or file and the credentials
+// of -auth-tokens and -auth-htpasswd. established connections are not
+// affected.
+type reloadable struct {
+	configFile string
+	config     *kellnerConfig // nil without -config
+
+	tls       *tlsReloader // nil without tls
+	tlsOpts   tlsOptions
+	idmap     *clientIDMuxer // nil without -idmap
+	idmapName string
+
+	auth         *clientAuth
+	authTokens   string
+	authHtpasswd string
+}
+
+// settings which are applied on SIGHUP, all others need a restart
+var reloadableFlags = map[string]bool{
+	"tls-cert":            true,
+	"tls-key":             true,
+	"tls-client-ca-file":  true,
+	"tls-crl":             true,
+	"require-client-cert": true,
+	"idmap":               true,
+	"auth-tokens":         true,
+	"auth-htpasswd":       true,
+}
+
+func reloadOnSIGHUP(rl *reloadable) {
+
+	var sigChan = make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+
+	for sig := range sigChan {
+		switch sig {
+		case syscall.SIGHUP:
+			log.Println("info: received SIGHUP, reloading")
+			rl.reload(flag.CommandLine)
+		}
+	}
+}
+
+func (rl *reloadable) reload(flags *flag.FlagSet) {
+
+	var (
+		tlsOpts   = rl.tlsOpts
+		idmapName = rl.idmapName
+		tokens    = rl.authTokens
+		htpasswd  = rl.authHtpasswd
+		config    = rl.config
+		err       error
+	)
+
+	if rl.configFile != "" {
+		if config, err = loadConfig(rl.configFile, flags); err != nil {
+			log.Printf("error: reloading -config: %v", err)
+			return
+		}
+		config.given = rl.config.given
+
+		flags.VisitAll(func(f *flag.Flag) {
+			var old, value = rl.config.value(flags, f.Name), config.value(flags, f.Name)
+			if old != value && !reloadableFlags[f.Name] {
+				log.Printf("warning: -config: %q changed from %q to %q, this requires a restart", f.Name, old, value)
+			}
+		})
+		if !reflect.DeepEqual(rl.config.Dirs, config.Dirs) {
+			log.Printf("warning: -config: the per-directory settings changed, this requires a restart")
+		}
+
+		tlsOpts.certFileName = config.value(flags, "tls-cert")
+		tlsOpts.keyFileName = config.value(flags, "tls-key")
+		tlsOpts.clientCasFileName = config.value(flags, "tls-client-ca-file")
+		tlsOpts.crlFileNames = splitList(config.value(flags, "tls-crl"))
+		tlsOpts.requireClientCert, _ = strconv.ParseBool(config.value(flags, "require-client-cert"))
+		idmapName = config.value(flags, "idmap")
+		tokens = config.value(flags, "auth-tokens")
+		htpasswd = config.value(flags, "auth-htpasswd")
+	}
+
+	// see main(), -require-client-cert rejects the clients using
+	// tokens or basic credentials
+	if tlsOpts.requireClientCert && (tokens != "" || htpasswd != "") {
+		log.Printf("error: reloading: -require-client-cert rejects the clients using -auth-tokens or -auth-htpasswd, keeping the current settings")
+		return
+	}
+
+	// load all parts first and apply them only if all of them are
+	// fine, a half-applied reload leaves kellner in a state nobody
+	// configured
+	var (
+		tlsCreds  *tlsCredentials
+		mapping   idMapping
+		authCreds *authCredentials
+	)
+
+	if rl.tls != nil {
+		if tlsCreds, err = loadTLSCredentials(&tlsOpts); err != nil {
+			log.Printf("error: reloading tls: %v, keeping the current settings", err)
+			return
+		}
+	} else if tlsOpts.certFileName != "" || tlsOpts.keyFileName != "" {
+		log.Printf("warning: enabling tls requires a restart")
+	}
+
+	switch {
+	case rl.idmap == nil && idmapName != "":
+		log.Printf("warning: enabling -idmap requires a restart")
+	case rl.idmap != nil && idmapName == "":
+		log.Printf("warning: disabling -idmap requires a restart")
+	case rl.idmap != nil:
+		if mapping, err = newIDMapping(idmapName); err != nil {
+			log.Printf("error: reloading -idmap %q: %v, keeping the current settings", idmapName, err)
+			return
+		}
+	}
+
+	if authCreds, err = loadAuthCredentials(tokens, htpasswd); err != nil {
+		log.Printf("error: reloading: %v, keeping the current settings", err)
+		return
+	}
+
+	if tlsCreds != nil {
+		rl.tls.Apply(tlsCreds)
+		rl.tlsOpts = tlsOpts
+	}
+
+	if mapping != nil {
+		if idmapName != rl.idmapName {
+			log.Printf("info: -idmap changed from %q to %q", rl.idmapName, idmapName)
+		}
+		rl.idmap.SetMapping(mapping)
+		rl.idmapName = idmapName
+		log.Printf("info: -idmap reloaded from %q", idmapName)
+	}
+
+	rl.auth.Apply(authCreds)
+	rl.authTokens, rl.authHtpasswd = tokens, htpasswd
+
+	rl.config = config
+	log.Println("info: reload done")
+}
@@ -0,0 +1,126 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2016, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// a reload failing in one part applies none of the parts
+func TestReloadAllOrNothing(t *testing.T) {
+
+	tmp, err := ioutil.TempDir("", "kellner-reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	writeFile := func(name, content string) string {
+		fileName := filepath.Join(tmp, name)
+		if err := ioutil.WriteFile(fileName, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return fileName
+	}
+	var (
+		tokens1    = writeFile("tokens1", "token1 O=SolSys,CN=one\n")
+		tokens2    = writeFile("tokens2", "token2 O=SolSys,CN=two\n")
+		badTokens  = writeFile("tokens3", "token3\n")
+		idmap1     = writeFile("idmap1.json", `{"clients": [{"id": "O=SolSys", "feeds": {"all": "all"}}]}`)
+		idmap2     = writeFile("idmap2.json", `{"clients": [{"id": "O=SolSys", "feeds": {"all": "stable"}}]}`)
+		configFile = filepath.Join(tmp, "kellner.toml")
+		flags      = flag.NewFlagSet("kellner", flag.ContinueOnError)
+	)
+	for _, name := range []string{"tls-cert", "tls-key", "tls-client-ca-file", "tls-crl", "idmap", "auth-tokens", "auth-htpasswd"} {
+		flags.String(name, "", "")
+	}
+	flags.Bool("require-client-cert", false, "")
+	flags.Parse(nil)
+
+	writeConfig := func(tokens, idmap string, extra ...string) {
+		writeFile("kellner.toml", fmt.Sprintf("auth-tokens = %q\nidmap = %q\n", tokens, idmap)+strings.Join(extra, ""))
+	}
+	writeConfig(tokens1, idmap1)
+	config, err := loadConfig(configFile, flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = config.applyTo(flags); err != nil {
+		t.Fatal(err)
+	}
+
+	auth := &clientAuth{}
+	if err = auth.Load(tokens1, ""); err != nil {
+		t.Fatal(err)
+	}
+	muxer := &clientIDMuxer{Auth: auth}
+	mapping, err := newIDMapping(idmap1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	muxer.SetMapping(mapping)
+
+	rl := &reloadable{
+		configFile: configFile,
+		config:     config,
+		idmap:      muxer,
+		idmapName:  idmap1,
+		auth:       auth,
+		authTokens: tokens1,
+	}
+
+	clientID := func(token string) string {
+		r := httptest.NewRequest("GET", "/all/Packages", nil)
+		r.TLS = &tls.ConnectionState{}
+		r.Header.Set("Authorization", "Bearer "+token)
+		id, _ := auth.of(r)
+		return id
+	}
+
+	mapped := func() string {
+		muxer.mu.RLock()
+		defer muxer.mu.RUnlock()
+		out, _ := muxer.Mapping.Map("O=SolSys", "/all/Packages")
+		return out
+	}
+
+	// the broken tokens keep the new -idmap out as well
+	writeConfig(badTokens, idmap2)
+	rl.reload(flags)
+	if mapped() != "/all/Packages" || clientID("token1") != "O=SolSys,CN=one" {
+		t.Errorf("expected the old -idmap and tokens to stay in place")
+	}
+	if rl.authTokens != tokens1 || rl.idmapName != idmap1 || rl.config.value(flags, "idmap") != idmap1 {
+		t.Errorf("expected the old settings to be remembered, got %q, %q", rl.authTokens, rl.idmapName)
+	}
+
+	writeConfig(tokens2, idmap2)
+	rl.reload(flags)
+	if mapped() != "/stable/Packages" || clientID("token1") != "" || clientID("token2") != "O=SolSys,CN=two" {
+		t.Errorf("expected the new -idmap and tokens to be applied")
+	}
+	if rl.authTokens != tokens2 || rl.idmapName != idmap2 || rl.config.value(flags, "idmap") != idmap2 {
+		t.Errorf("expected the new settings to be remembered, got %q, %q", rl.authTokens, rl.idmapName)
+	}
+
+	// -require-client-cert rejects the token clients, see main()
+	writeConfig(tokens1, idmap1, "require-client-cert = true\n")
+	rl.reload(flags)
+	if mapped() != "/stable/Packages" || clientID("token2") != "O=SolSys,CN=two" || rl.tlsOpts.requireClientCert {
+		t.Errorf("expected -require-client-cert with -auth-tokens to be refused")
+	}
+}
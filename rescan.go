@@ -18,7 +18,7 @@ import (
 
 // on SIGUSR2 kellner rescans root. if another scan is already running
 // we just ignore the signal.
-func rescan(root, cache string, nworkers int, doMD5, doSHA1 bool, gzipper gzWrite) {
+func rescan(root, cache string, opts *scanOptions) {
 
 	var (
 		sigChan = make(chan os.Signal, 1)
@@ -39,7 +39,7 @@ func rescan(root, cache string, nworkers int, doMD5, doSHA1 bool, gzipper gzWrit
 			case <-doScan:
 				go func() {
 					log.Println("info: start a rescan.")
-					scanRoot(root, cache, nworkers, doMD5, doSHA1, gzipper)
+					scanRoot(root, cache, opts)
 					doScan <- true
 				}()
 			case <-time.After(1 * time.Millisecond):
@@ -17,94 +17,392 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
+
+	"golang.org/x/crypto/openpgp"
 )
 
-func scanRoot(root, cache string, nworkers int, doMD5, doSHA1 bool, gzipper gzWrite) {
+// scanOptions control how scanRoot scans the packages and what
+// kind of index files it creates
+type scanOptions struct {
+	nworkers int
+	doMD5    bool
+	doSHA1   bool
+	doSHA256 bool
+	gzipper  gzWrite
+	usignKey *usignKey       // if set, sign 'Packages' => 'Packages.sig'
+	pgpKey   *openpgp.Entity // if set, sign 'Release' => 'Release.gpg', 'InRelease'
+
+	checkDeps     bool // validate dependencies, see checkDir()
+	checkSiblings bool // resolve dependencies across sibling directories
+
+	dirs []dirScanOptions // per-directory overrides, longest path first
+}
+
+// dirScanOptions overrides the scanOptions for the directory 'path'
+// (relative to -root) and all directories below it. 'signKey' and
+// 'gpgKey' name the key files in use.
+type dirScanOptions struct {
+	path    string
+	signKey string
+	gpgKey  string
+	opts    *scanOptions
+}
+
+// dirFor returns the override for 'relPath' (relative to -root)
+// or nil if there is none
+func (opts *scanOptions) dirFor(relPath string) *dirScanOptions {
+	relPath = filepath.ToSlash(filepath.Clean(relPath))
+	for i, dir := range opts.dirs {
+		if dir.path == "." || relPath == dir.path || strings.HasPrefix(relPath, dir.path+"/") {
+			return &opts.dirs[i]
+		}
+	}
+	return nil
+}
+
+// forDir returns the scanOptions to use for 'relPath' (relative to -root)
+func (opts *scanOptions) forDir(relPath string) *scanOptions {
+	if dir := opts.dirFor(relPath); dir != nil {
+		return dir.opts
+	}
+	return opts
+}
+
+func scanRoot(root, cache string, opts *scanOptions) {
+	scanTree(root, cache, root, opts)
+}
+
+// scanTree scans 'top' and all directories below it. 'top' is either
+// 'root' or a directory inside 'root'.
+func scanTree(root, cache, top string, opts *scanOptions) {
 
-	filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+	filepath.Walk(top, func(path string, fi os.FileInfo, err error) error {
 
 		if fi == nil || !fi.IsDir() {
 
 			// not existing root-directory. we don't crash or exit here, the
 			// operator might create it later on and trigger a rescan.
-			if fi == nil && root == path {
-				log.Printf("warning: not existent root directory %q\n", root)
+			if fi == nil && top == path {
+				log.Printf("warning: not existent root directory %q\n", top)
 			}
 
 			return nil
 		}
 
-		// skip cache-directory
-		if strings.HasPrefix(path, cache) {
+		// skip cache-directory and directories of running imports
+		if isSubPath(path, cache) || isStagingName(fi.Name()) {
 			return filepath.SkipDir
 		}
 
-		var (
-			now          = time.Now()
-			relPath, _   = filepath.Rel(root, path)
-			cachePath, _ = filepath.Abs(filepath.Join(cache, relPath))
-			scanner      = packageScanner{
-				cache:  cachePath,
-				doMD5:  doMD5,
-				doSHA1: doSHA1,
-			}
-		)
-
-		if err = scanner.scan(path, nworkers); err != nil {
+		if err := scanDir(root, cache, path, opts); err != nil {
 			log.Printf("error: %v", err)
-			return nil
 		}
+		return nil
+	})
+}
 
-		log.Printf("done building index for %q", path)
-		log.Printf("time to parse %d packages in %q: %s\n",
-			scanner.packages.Len(), path, time.Since(now))
+// dirScans serializes the scans of a directory (-watch, SIGUSR2,
+// uploads, imports and gc might ask for the same directory at the same
+// time): only one scan per directory runs at a time, all requests
+// arriving while it runs are coalesced into one follow-up scan. the
+// uploads and imports changing a directory are serialized as well, see
+// lockForChange().
+var dirScans = struct {
+	sync.Mutex
+	dirs map[string]*dirScan
+}{dirs: make(map[string]*dirScan)}
+
+type dirScan struct {
+	running  sync.Mutex   // held while scanning
+	next     *scanCall    // the follow-up scan, not started yet
+	changing sync.RWMutex // see lockForChange()
+	archs    []string     // of the packages found by the last scan, see indexedDirs()
+}
 
-		//
-		// write the package index
-		//
+// dirScanFor returns the dirScan of the absolute path 'key'
+func dirScanFor(key string) *dirScan {
+	dirScans.Lock()
+	defer dirScans.Unlock()
+	ds := dirScans.dirs[key]
+	if ds == nil {
+		ds = &dirScan{}
+		dirScans.dirs[key] = ds
+	}
+	return ds
+}
 
-		var indexName = filepath.Join(cachePath, "Packages")
-		var indexNameGz = indexName + ".gz"
-		var indexNameStamps = indexName + ".stamps"
+// lockForChange serializes uploads and imports: an import replaces 'dir'
+// as a whole and locks it 'exclusive', an upload adds to 'dir' and locks
+// it shared. the directories between 'root' and 'dir' are locked shared,
+// no import replaces them meanwhile. the locks are taken from 'root'
+// downwards, the returned function releases them.
+func lockForChange(root, dir string, exclusive bool) func() {
 
-		var packagesFile, packagesFileGz, packagesFileStamps *os.File
-		if packagesFile, err = ioutil.TempFile(cachePath, "Packages"); err != nil {
-			log.Printf("error: can't create the Packages file in %q: %v\n", cachePath, err)
-			return nil
+	root, _ = filepath.Abs(root)
+	dir, _ = filepath.Abs(dir)
+
+	var dirs = []string{dir}
+	for d := dir; d != root && d != filepath.Dir(d); {
+		d = filepath.Dir(d)
+		dirs = append([]string{d}, dirs...)
+	}
+
+	var unlocks []func()
+	for i, d := range dirs {
+		ds := dirScanFor(d)
+		if exclusive && i == len(dirs)-1 {
+			ds.changing.Lock()
+			unlocks = append(unlocks, ds.changing.Unlock)
+		} else {
+			ds.changing.RLock()
+			unlocks = append(unlocks, ds.changing.RUnlock)
 		}
-		defer packagesFile.Close()
-		if packagesFileGz, err = os.Create(packagesFile.Name() + ".gz"); err != nil {
-			log.Printf("error: can't create the Packages.gz file in %q: %v\n", cachePath, err)
-			return nil
+	}
+	return func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
 		}
-		defer packagesFileGz.Close()
+	}
+}
 
-		if packagesFileStamps, err = os.Create(packagesFile.Name() + ".stamps"); err != nil {
-			log.Printf("error: can't create the Packages.stamps file in %q: %v\n", cachePath, err)
-			return nil
+// indexedDirs returns the directories below the absolute path 'top'
+// (including 'top') whose last scan found packages, together with the
+// architectures of these packages. a directory removed since its last
+// scan is still listed.
+func indexedDirs(top string) map[string][]string {
+	dirScans.Lock()
+	defer dirScans.Unlock()
+	var dirs = make(map[string][]string)
+	for dir, ds := range dirScans.dirs {
+		if ds.archs != nil && isSubPath(dir, top) {
+			dirs[dir] = ds.archs
 		}
-		defer packagesFileStamps.Close()
+	}
+	return dirs
+}
 
-		var index = scanner.packages.String()
+type scanCall struct {
+	done chan struct{}
+	err  error
+}
 
-		io.Copy(packagesFile, strings.NewReader(index))
-		packagesFile.Sync()
-		gzipper(packagesFileGz, strings.NewReader(index))
-		packagesFileGz.Sync()
-		scanner.packages.StampsTo(packagesFileStamps)
-		packagesFileStamps.Sync()
+// scanDir scans the packages in 'path' and writes the index files into
+// the corresponding folder below 'cache', see scanDirNow(). a scan of
+// 'path' which is already running is not joined (it might miss the
+// change the caller wants to see), the caller waits for the next one.
+func scanDir(root, cache, path string, opts *scanOptions) error {
 
-		os.Remove(indexName)
-		os.Remove(indexNameGz)
-		os.Remove(indexNameStamps)
-		os.Rename(packagesFile.Name(), indexName)
-		os.Rename(packagesFileGz.Name(), indexNameGz)
-		os.Rename(packagesFileStamps.Name(), indexNameStamps)
+	key, _ := filepath.Abs(path)
+	ds := dirScanFor(key)
 
-		return nil
-	})
+	dirScans.Lock()
+	if call := ds.next; call != nil {
+		dirScans.Unlock()
+		<-call.done
+		return call.err
+	}
+	call := &scanCall{done: make(chan struct{})}
+	ds.next = call
+	dirScans.Unlock()
+
+	ds.running.Lock()
+	dirScans.Lock()
+	ds.next = nil // requests from now on need another scan
+	dirScans.Unlock()
+
+	call.err = scanDirNow(root, cache, path, opts)
+	ds.running.Unlock()
+	close(call.done)
+	return call.err
+}
+
+// scanDirNow scans the packages in 'path' and writes the index files into
+// the corresponding folder below 'cache'. all index files are written as
+// temporary files first and then renamed in one go.
+func scanDirNow(root, cache, path string, opts *scanOptions) error {
+
+	var (
+		err          error
+		now          = time.Now()
+		relPath, _   = filepath.Rel(root, path)
+		cachePath, _ = filepath.Abs(filepath.Join(cache, relPath))
+	)
+
+	opts = opts.forDir(relPath)
+	var scanner = packageScanner{
+		cache:    cachePath,
+		doMD5:    opts.doMD5,
+		doSHA1:   opts.doSHA1,
+		doSHA256: opts.doSHA256,
+	}
+
+	if err = scanner.scan(path, opts.nworkers); err != nil {
+		return err
+	}
+
+	log.Printf("done building index for %q", path)
+	log.Printf("time to parse %d packages in %q: %s\n",
+		scanner.packages.Len(), path, time.Since(now))
+
+	//
+	// write the package index
+	//
+
+	var indexName = filepath.Join(cachePath, "Packages")
+	var indexNameGz = indexName + ".gz"
+	var indexNameStamps = indexName + ".stamps"
+	var indexNameSig = indexName + ".sig"
+	var indexNameRelease = filepath.Join(cachePath, "Release")
+	var indexNameReleaseGpg = indexNameRelease + ".gpg"
+	var indexNameInRelease = filepath.Join(cachePath, "InRelease")
+
+	// all index files are written to temp files first and then renamed
+	// over the old ones, rename replaces them atomically. 'pending' lists
+	// the temp files which are not renamed yet, they are removed when
+	// scanDir bails out. the files are renamed one after another in the
+	// order of 'pending': the Packages files first, the Release files
+	// last. a client might see a new Packages next to the old
+	// Packages.sig for a moment, but a Release never lists index
+	// files which are not in place yet.
+	type indexFile struct {
+		file *os.File
+		name string
+	}
+	var pending []indexFile
+	defer func() {
+		for _, f := range pending {
+			f.file.Close()
+			os.Remove(f.file.Name())
+		}
+	}()
+
+	var packagesFile, packagesFileGz, packagesFileStamps, packagesFileSig *os.File
+	var releaseFile, releaseFileGpg, inReleaseFile *os.File
+	if packagesFile, err = ioutil.TempFile(cachePath, "Packages"); err != nil {
+		return fmt.Errorf("can't create the Packages file in %q: %v", cachePath, err)
+	}
+	pending = append(pending, indexFile{packagesFile, indexName})
+
+	create := func(suffix, name string) (*os.File, error) {
+		file, err := os.Create(packagesFile.Name() + suffix)
+		if err != nil {
+			return nil, fmt.Errorf("can't create the %s file in %q: %v", filepath.Base(name), cachePath, err)
+		}
+		pending = append(pending, indexFile{file, name})
+		return file, nil
+	}
+
+	if packagesFileGz, err = create(".gz", indexNameGz); err != nil {
+		return err
+	}
+	if packagesFileStamps, err = create(".stamps", indexNameStamps); err != nil {
+		return err
+	}
+	if opts.usignKey != nil {
+		if packagesFileSig, err = create(".sig", indexNameSig); err != nil {
+			return err
+		}
+	}
+	if releaseFile, err = create(".release", indexNameRelease); err != nil {
+		return err
+	}
+	if opts.pgpKey != nil {
+		if releaseFileGpg, err = create(".release.gpg", indexNameReleaseGpg); err != nil {
+			return err
+		}
+		if inReleaseFile, err = create(".inrelease", indexNameInRelease); err != nil {
+			return err
+		}
+	}
+
+	var index = scanner.packages.String()
+
+	if _, err = io.Copy(packagesFile, strings.NewReader(index)); err != nil {
+		return fmt.Errorf("writing the Packages file in %q: %v", cachePath, err)
+	}
+	if err = opts.gzipper(packagesFileGz, strings.NewReader(index)); err != nil {
+		return fmt.Errorf("compressing the Packages file in %q: %v", cachePath, err)
+	}
+	if err = scanner.packages.StampsTo(packagesFileStamps); err != nil {
+		return fmt.Errorf("writing the Packages.stamps file in %q: %v", cachePath, err)
+	}
+	if packagesFileSig != nil {
+		if err = opts.usignKey.SignatureTo(packagesFileSig, []byte(index)); err != nil {
+			return fmt.Errorf("signing the Packages file in %q: %v", cachePath, err)
+		}
+	}
+
+	var release = newRelease(scanner.packages)
+	if err = release.AddFile("Packages", packagesFile.Name()); err != nil {
+		log.Printf("error: adding Packages to the Release file in %q: %v\n", cachePath, err)
+	}
+	if err = release.AddFile("Packages.gz", packagesFileGz.Name()); err != nil {
+		log.Printf("error: adding Packages.gz to the Release file in %q: %v\n", cachePath, err)
+	}
+	var releaseContent = release.String()
+	if _, err = io.WriteString(releaseFile, releaseContent); err != nil {
+		return fmt.Errorf("writing the Release file in %q: %v", cachePath, err)
+	}
+	if opts.pgpKey != nil {
+		if err = pgpDetachSignTo(releaseFileGpg, opts.pgpKey, []byte(releaseContent)); err != nil {
+			return fmt.Errorf("signing the Release file in %q: %v", cachePath, err)
+		}
+		if err = pgpClearSignTo(inReleaseFile, opts.pgpKey, []byte(releaseContent)); err != nil {
+			return fmt.Errorf("clearsigning the Release file in %q: %v", cachePath, err)
+		}
+	}
+
+	for _, f := range pending {
+		f.file.Sync()
+		if err = f.file.Close(); err != nil {
+			return fmt.Errorf("writing %q: %v", f.file.Name(), err)
+		}
+	}
+	for len(pending) > 0 {
+		if err = os.Rename(pending[0].file.Name(), pending[0].name); err != nil {
+			return fmt.Errorf("replacing %q: %v", pending[0].name, err)
+		}
+		pending = pending[1:]
+	}
+
+	// the signatures of a former scan do not match anymore
+	if opts.usignKey == nil {
+		os.Remove(indexNameSig)
+	}
+	if opts.pgpKey == nil {
+		os.Remove(indexNameReleaseGpg)
+		os.Remove(indexNameInRelease)
+	}
+
+	// remember the architectures for opkgConfTo(), it does not read
+	// the Packages files per request
+	var archs []string
+	if scanner.packages.Len() > 0 {
+		var seen = make(map[string]bool)
+		archs = []string{}
+		for _, pkg := range scanner.packages.Entries {
+			if arch := pkg.Header["Architecture"]; !seen[arch] {
+				seen[arch] = true
+				archs = append(archs, arch)
+			}
+		}
+	}
+	key, _ := filepath.Abs(path)
+	ds := dirScanFor(key)
+	dirScans.Lock()
+	ds.archs = archs
+	dirScans.Unlock()
+
+	if opts.checkDeps {
+		if err = checkDir(root, cache, path, scanner.packages, opts.checkSiblings); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 type packageScanner struct {
@@ -112,9 +410,10 @@ type packageScanner struct {
 	nScanned int64
 	nCached  int64
 
-	cache  string
-	doSHA1 bool
-	doMD5  bool
+	cache    string
+	doSHA1   bool
+	doMD5    bool
+	doSHA256 bool
 }
 
 func (s *packageScanner) clear() {
@@ -154,7 +453,7 @@ func (s *packageScanner) scan(dirPath string, nworkers int) error {
 			continue
 		}
 
-		if s.fromCache(entry) {
+		if s.fromCache(dirPath, entry) {
 			continue
 		}
 
@@ -177,7 +476,7 @@ func (s *packageScanner) scanAndCache(filePath string, worker *workerPool) {
 		log.Println("processed", filePath, time.Now().Sub(n))
 	}()
 
-	var archive, err = newIpkFromFile(filePath, s.doMD5, s.doSHA1)
+	var archive, err = newIpkFromFile(filePath, s.doMD5, s.doSHA1, s.doSHA256)
 	if err != nil {
 		log.Printf("error: %v\n", err)
 		return
@@ -189,34 +488,46 @@ func (s *packageScanner) scanAndCache(filePath string, worker *workerPool) {
 		return
 	}
 
-	var cacheName = genCachedControlName(filepath.Base(filePath), s.cache)
-	if err = ioutil.WriteFile(cacheName, []byte(archive.Control), 0644); err != nil {
-		log.Println(cacheName, err)
+	if err = writeIpkCacheRecord(archive, s.cache); err != nil {
+		log.Println(filePath, err)
 	}
 }
 
-func (s *packageScanner) fromCache(entry os.FileInfo) bool {
+func (s *packageScanner) fromCache(dirPath string, entry os.FileInfo) bool {
 
-	var controlName = genCachedControlName(entry.Name(), s.cache)
-	var cacheEntry, err = os.Stat(controlName)
-	if err != nil {
+	if s.cache == "" {
 		return false
 	}
-	if entry.ModTime().Before(cacheEntry.ModTime()) {
-		var archive, err = newIpkFromCache(entry.Name(), s.cache, s.doMD5, s.doSHA1)
-		if err != nil {
+
+	var archive, err = newIpkFromCache(entry, s.cache, s.doMD5, s.doSHA1, s.doSHA256)
+	if err != nil {
+		if err != errCacheOutdated && !os.IsNotExist(err) {
 			log.Printf("error: %v\n", err)
-			return false
 		}
-		s.packages.Add(entry.Name(), archive)
-		s.nCached += 1
-		return true
+		return false
 	}
-	return false
+	archive.ScanLocation = path.Join(dirPath, entry.Name())
+	s.packages.Add(entry.Name(), archive)
+	s.nCached += 1
+	return true
 }
 
 func (s *packageScanner) skipNonPackage(fi os.FileInfo) bool {
-	return path.Ext(fi.Name()) != ".ipk" || fi.IsDir()
+	return !isPackageName(fi.Name()) || fi.IsDir()
+}
+
+// packageExtensions lists the file extensions kellner treats as
+// packages: .ipk for opkg feeds and .deb for apt repositories.
+var packageExtensions = []string{".ipk", ".deb"}
+
+func isPackageName(name string) bool {
+	var ext = path.Ext(name)
+	for i := range packageExtensions {
+		if ext == packageExtensions[i] {
+			return true
+		}
+	}
+	return false
 }
 
 func (s *packageScanner) provideCachePath() error {
@@ -230,7 +541,7 @@ func (s *packageScanner) provideCachePath() error {
 	return nil
 }
 
-func genCachedControlName(name, cache string) string {
+func genCachedRecordName(name, cache string) string {
 	var cacheName = filepath.Join(cache, name)
-	return cacheName + ".control"
+	return cacheName + ".json"
 }
@@ -0,0 +1,225 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2016, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// a scan served from the cache must yield the very same index
+// as a fresh scan
+func TestScanFromCache(t *testing.T) {
+
+	tmp, err := ioutil.TempDir("", "kellner-scan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		root  = filepath.Join(tmp, "root")
+		cache = filepath.Join(tmp, "cache")
+		gz    = func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }
+	)
+	os.MkdirAll(root, 0755)
+	ipk := mockIpk(t, "control.tar.gz", gz)
+	if err = ioutil.WriteFile(filepath.Join(root, "foo_1.0-r0_all.ipk"), ipk, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	scan := func() *packageScanner {
+		s := &packageScanner{cache: cache, doMD5: true, doSHA1: true, doSHA256: true}
+		if err := s.scan(root, 1); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	fresh, cached := scan(), scan()
+	if fresh.nScanned != 1 || cached.nCached != 1 {
+		t.Fatalf("expected 1 fresh and 1 cached package, got %d|%d", fresh.nScanned, cached.nCached)
+	}
+	if fresh.packages.String() != cached.packages.String() {
+		t.Fatalf("index differs:\nfresh:\n%s\ncached:\n%s", fresh.packages.String(), cached.packages.String())
+	}
+}
+
+// a .deb carries its sha256 even without -sha256 and the Release file
+// lists the index files with their size and checksums
+func TestScanDebRelease(t *testing.T) {
+
+	tmp, err := ioutil.TempDir("", "kellner-scan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		root  = filepath.Join(tmp, "root")
+		cache = filepath.Join(tmp, "cache")
+		gz    = func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }
+		deb   = mockIpkControl(t, "control.tar.gz", gz, "Package: foo\nVersion: 1.0\nArchitecture: amd64\n")
+		ipk   = mockIpkControl(t, "control.tar.gz", gz, "Package: bar\nVersion: 1.0\nArchitecture: all\n")
+		opts  = &scanOptions{nworkers: 1, gzipper: gzGolang, doMD5: true}
+	)
+	os.MkdirAll(root, 0755)
+	ioutil.WriteFile(filepath.Join(root, "foo_1.0_amd64.deb"), deb, 0644)
+	ioutil.WriteFile(filepath.Join(root, "bar_1.0_all.ipk"), ipk, 0644)
+
+	sha := func(content []byte) string {
+		sum := sha256.Sum256(content)
+		return hex.EncodeToString(sum[:])
+	}
+	read := func(name string) []byte {
+		content, err := ioutil.ReadFile(filepath.Join(cache, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return content
+	}
+
+	// the second scan is served from the cache
+	for _, from := range []string{"fresh", "cache"} {
+		if err = scanDir(root, cache, root, opts); err != nil {
+			t.Fatal(err)
+		}
+
+		index := string(read("Packages"))
+		if !strings.Contains(index, "SHA256: "+sha(deb)+"\n") {
+			t.Errorf("%s: expected the sha256 of the .deb in\n%s", from, index)
+		}
+		if strings.Contains(index, "SHA256sum:") {
+			t.Errorf("%s: expected no sha256 for the .ipk without -sha256 in\n%s", from, index)
+		}
+
+		release := string(read("Release"))
+		if !strings.Contains(release, "Architectures: all amd64\n") {
+			t.Errorf("%s: expected the architectures in\n%s", from, release)
+		}
+		for _, name := range []string{"Packages", "Packages.gz"} {
+			content := read(name)
+			line := fmt.Sprintf(" %s %16d %s\n", sha(content), len(content), name)
+			if !strings.Contains(release, "SHA256:\n") || !strings.Contains(release, line) {
+				t.Errorf("%s: expected %q in\n%s", from, line, release)
+			}
+		}
+	}
+}
+
+// a failing part of the index leaves the former index files in place
+func TestScanKeepsIndexOnError(t *testing.T) {
+
+	tmp, err := ioutil.TempDir("", "kellner-scan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		root  = filepath.Join(tmp, "root")
+		cache = filepath.Join(tmp, "cache")
+		gz    = func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }
+		opts  = &scanOptions{nworkers: 1, gzipper: gzGolang}
+	)
+	os.MkdirAll(root, 0755)
+	ioutil.WriteFile(filepath.Join(root, "foo_1.0-r0_all.ipk"), mockIpk(t, "control.tar.gz", gz), 0644)
+	if err = scanDir(root, cache, root, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	read := func(name string) []byte {
+		content, err := ioutil.ReadFile(filepath.Join(cache, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return content
+	}
+	var (
+		packages, packagesGz, release = read("Packages"), read("Packages.gz"), read("Release")
+		files                         = listCacheDir(t, cache)
+	)
+
+	reader, err := gzip.NewReader(bytes.NewReader(packagesGz))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unzipped, err := ioutil.ReadAll(reader); err != nil || !bytes.Equal(unzipped, packages) {
+		t.Fatalf("expected Packages.gz to contain Packages, got %v", err)
+	}
+
+	ioutil.WriteFile(filepath.Join(root, "foo_2.0-r0_all.ipk"), mockIpk(t, "control.tar.gz", gz), 0644)
+	opts.gzipper = func(w io.Writer, r io.Reader) error {
+		io.WriteString(w, "truncated")
+		return errors.New("gzip failed")
+	}
+	if err = scanDir(root, cache, root, opts); err == nil {
+		t.Fatalf("expected the failing gzip to fail the scan")
+	}
+	if !bytes.Equal(read("Packages"), packages) || !bytes.Equal(read("Packages.gz"), packagesGz) || !bytes.Equal(read("Release"), release) {
+		t.Errorf("expected the former index files to stay in place")
+	}
+	if names := listCacheDir(t, cache); fmt.Sprint(names) != fmt.Sprint(files) {
+		t.Errorf("expected no temp files to be left behind, got %v", names)
+	}
+}
+
+// listCacheDir returns the names of the files in 'dir' except the
+// cache records
+func listCacheDir(t *testing.T, dir string) []string {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			names = append(names, entry.Name())
+		}
+	}
+	return names
+}
+
+// only the cache itself is skipped, not a feed with a similar name
+func TestScanTreeSkipsCache(t *testing.T) {
+
+	tmp, err := ioutil.TempDir("", "kellner-scan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		root  = filepath.Join(tmp, "root")
+		cache = filepath.Join(root, "cache")
+		gz    = func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }
+	)
+	for _, dir := range []string{cache, cache + "2"} {
+		os.MkdirAll(dir, 0755)
+		ioutil.WriteFile(filepath.Join(dir, "foo_1.0-r0_all.ipk"), mockIpk(t, "control.tar.gz", gz), 0644)
+	}
+
+	scanRoot(root, cache, &scanOptions{nworkers: 1, gzipper: gzGolang})
+	if _, err = os.Stat(filepath.Join(cache, "cache2", "Packages")); err != nil {
+		t.Errorf("expected cache2 to be scanned: %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(cache, "cache", "Packages")); err == nil {
+		t.Errorf("expected the cache not to be scanned")
+	}
+}
@@ -9,12 +9,17 @@
 package main
 
 import (
+	"bytes"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/pem"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	// enforce linking of several crypto-hashes
 	_ "crypto/sha256"
@@ -25,58 +30,259 @@ type tlsOptions struct {
 	keyFileName       string
 	certFileName      string
 	clientCasFileName string
+	crlFileNames      []string
 	requireClientCert bool
+	askClientCert     bool         // ask for (but do not require) client-certs, see main()
+	clientID          clientIDFunc // used to log rejected client-certs
+	profile           string       // see -tls-profile
+	http2             bool         // offer "h2", see -tls-http2
 }
 
-func initTLS(listener net.Listener, opts *tlsOptions) (net.Listener, error) {
+// tlsCredentials are the parts of the tls setup which are
+// reloaded on SIGHUP, see (*tlsReloader).Apply()
+type tlsCredentials struct {
+	cert       *tls.Certificate
+	leaf       *x509.Certificate
+	clientCAs  *x509.CertPool
+	caCerts    []*x509.Certificate
+	crls       *crlSet // nil without -tls-crl
+	clientAuth tls.ClientAuthType
+}
+
+// tlsReloader hands out the current tlsCredentials to each new
+// connection (via GetCertificate and GetConfigForClient). established
+// connections keep the credentials they were started with.
+type tlsReloader struct {
+	mu       sync.Mutex // serializes Apply() and watchCRLs()
+	config   *tls.Config
+	creds    atomic.Value // *tlsCredentials
+	clientID clientIDFunc
+}
+
+func initTLS(listener net.Listener, opts *tlsOptions) (net.Listener, *tlsReloader, error) {
+
+	profile, err := tlsProfileByName(opts.profile)
+	if err != nil {
+		return listener, nil, err
+	}
+
+	creds, err := loadTLSCredentials(opts)
+	if err != nil {
+		return listener, nil, err
+	}
+
+	if creds.clientCAs != nil {
+		log.Printf("added %d certs from %q to ca-certs", len(creds.caCerts), opts.clientCasFileName)
+	}
+	if creds.crls != nil {
+		log.Printf("loaded crls from %q, %d revoked certs", opts.crlFileNames, creds.crls.nrevoked())
+	}
+	if creds.clientAuth == tls.RequireAndVerifyClientCert {
+		log.Println("tls.RequireAndVerifyClientCert")
+	}
+
+	var reloader = &tlsReloader{clientID: opts.clientID}
+	reloader.creds.Store(creds)
+	reloader.config = &tls.Config{
+		GetCertificate:     reloader.getCertificate,
+		GetConfigForClient: reloader.getConfigForClient,
+		VerifyConnection:   reloader.verifyConnection,
+		ClientAuth:         creds.clientAuth,
+		ClientCAs:          creds.clientCAs,
+	}
+	profile.applyTo(reloader.config, opts.http2)
+	log.Println(describeTLSConfig(profile.name, reloader.config))
+
+	return tls.NewListener(listener, reloader.config), reloader, nil
+}
+
+func loadTLSCredentials(opts *tlsOptions) (*tlsCredentials, error) {
 
 	cert, err := tls.LoadX509KeyPair(opts.certFileName, opts.keyFileName)
 	if err != nil {
-		return listener, fmt.Errorf("loading x509-keypair from %q - %q failed: %v", opts.certFileName, opts.keyFileName, err)
-	}
-
-	tlsConfig := &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		// disable ssl3 and tls1.0 (protect against beast, poodle etc)
-		MinVersion: tls.VersionTLS11,
-		NextProtos: []string{"http/1.1"},
-		// avoid rc4
-		CipherSuites: []uint16{
-			tls.TLS_RSA_WITH_AES_128_CBC_SHA,
-			tls.TLS_RSA_WITH_AES_256_CBC_SHA,
-			tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
-			tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
-			tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
-			tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
-			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
-			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
-		},
+		return nil, fmt.Errorf("loading x509-keypair from %q - %q failed: %v", opts.certFileName, opts.keyFileName, err)
+	}
+
+	var creds = &tlsCredentials{cert: &cert}
+	if creds.leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, fmt.Errorf("parsing x509-cert from %q failed: %v", opts.certFileName, err)
 	}
 
 	if opts.clientCasFileName != "" {
 		certBytes, err := ioutil.ReadFile(opts.clientCasFileName)
 		if err != nil {
-			return listener, fmt.Errorf("loading ca-certs from %q failed: %v", opts.clientCasFileName, err)
+			return nil, fmt.Errorf("loading ca-certs from %q failed: %v", opts.clientCasFileName, err)
 		}
 
-		tlsConfig.ClientCAs = x509.NewCertPool()
-		if ok := tlsConfig.ClientCAs.AppendCertsFromPEM(certBytes); !ok {
-			return listener, fmt.Errorf("adding ca-certs from %q to the pool failed", opts.clientCasFileName)
+		creds.clientCAs = x509.NewCertPool()
+		for block, rest := pem.Decode(certBytes); block != nil; block, rest = pem.Decode(rest) {
+			if block.Type != "CERTIFICATE" || len(block.Headers) != 0 {
+				continue
+			}
+			ca, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				continue
+			}
+			creds.clientCAs.AddCert(ca)
+			creds.caCerts = append(creds.caCerts, ca)
+		}
+		if len(creds.caCerts) == 0 {
+			return nil, fmt.Errorf("adding ca-certs from %q to the pool failed", opts.clientCasFileName)
+		}
+	}
+
+	if len(opts.crlFileNames) > 0 {
+		if creds.clientCAs == nil {
+			return nil, fmt.Errorf("-tls-crl requires -tls-client-ca-file")
 		}
+		if creds.crls, err = loadCRLs(opts.crlFileNames, creds.caCerts); err != nil {
+			return nil, err
+		}
+	}
 
-		log.Printf("added %d certs from %q to ca-certs", len(tlsConfig.ClientCAs.Subjects()), opts.clientCasFileName)
+	// ask for (but do not require) client-certs if something uses
+	// them, eg. uploads. otherwise the handshake stays as it was.
+	if creds.clientCAs != nil && opts.askClientCert {
+		creds.clientAuth = tls.VerifyClientCertIfGiven
 	}
 
 	if opts.requireClientCert {
-		tlsConfig.ClientAuth = tls.RequireAnyClientCert
+		creds.clientAuth = tls.RequireAnyClientCert
 
 		// user gave a list of client-cas. this indicates that she wants
 		// to check the http-client-certs
-		if tlsConfig.ClientCAs != nil {
-			log.Println("tls.RequireAndVerifyClientCert")
-			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		if creds.clientCAs != nil {
+			creds.clientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	return creds, nil
+}
+
+func (tr *tlsReloader) credentials() *tlsCredentials {
+	return tr.creds.Load().(*tlsCredentials)
+}
+
+func (tr *tlsReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return tr.credentials().cert, nil
+}
+
+func (tr *tlsReloader) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	var (
+		creds  = tr.credentials()
+		config = tr.config.Clone()
+	)
+	config.GetConfigForClient = nil
+	config.ClientAuth = creds.clientAuth
+	config.ClientCAs = creds.clientCAs
+	return config, nil
+}
+
+// verifyConnection rejects client-certs revoked by one of the CRLs.
+// it's called after the regular verification of the client-cert, for
+// resumed sessions as well: a client-cert revoked after the first
+// handshake must not live on via session resumption.
+func (tr *tlsReloader) verifyConnection(state tls.ConnectionState) error {
+
+	var crls = tr.credentials().crls
+	if crls == nil {
+		return nil
+	}
+
+	for _, chain := range state.VerifiedChains {
+		for _, cert := range chain {
+			at, revoked := crls.isRevoked(cert)
+			if !revoked {
+				continue
+			}
+			var what = "revoked"
+			if cert != chain[0] {
+				what = fmt.Sprintf("issuing cert %q revoked", clientIDByName(&cert.Subject))
+			}
+			log.Printf("warning: tls: rejected client-cert %q (serial %s): %s since %s",
+				tr.clientID.of(chain[0]), cert.SerialNumber, what, at.Format(time.RFC3339))
+			return fmt.Errorf("certificate %q is revoked", clientIDByName(&cert.Subject))
 		}
 	}
+	return nil
+}
+
+// watchCRLs reloads the CRLs every 'interval' if any of the files changed
+func (tr *tlsReloader) watchCRLs(interval time.Duration) {
+	for range time.Tick(interval) {
+		tr.mu.Lock()
+		var creds = tr.credentials()
+		if creds.crls == nil || !creds.crls.changed() {
+			tr.mu.Unlock()
+			continue
+		}
+
+		crls, err := loadCRLs(creds.crls.files, creds.caCerts)
+		if err != nil {
+			log.Printf("error: tls: reloading crls: %v, keeping the current ones", err)
+		} else {
+			var update = *creds
+			update.crls = crls
+			tr.creds.Store(&update)
+			log.Printf("info: tls: reloaded crls, %d revoked certs", crls.nrevoked())
+		}
+		tr.mu.Unlock()
+	}
+}
+
+// Apply replaces the current credentials by 'creds' (see
+// loadTLSCredentials()) and logs what changed
+func (tr *tlsReloader) Apply(creds *tlsCredentials) {
 
-	return tls.NewListener(listener, tlsConfig), nil
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	var old = tr.credentials()
+	tr.creds.Store(creds)
+
+	if bytes.Equal(old.leaf.Raw, creds.leaf.Raw) {
+		log.Printf("info: tls: server-cert unchanged")
+	} else {
+		log.Printf("info: tls: server-cert changed: %q (valid until %s) => %q (valid until %s)",
+			clientIDByName(&old.leaf.Subject), old.leaf.NotAfter.Format(time.RFC3339),
+			clientIDByName(&creds.leaf.Subject), creds.leaf.NotAfter.Format(time.RFC3339))
+	}
+
+	var added, removed = diffCerts(old.caCerts, creds.caCerts)
+	for _, ca := range added {
+		log.Printf("info: tls: added ca-cert %q", clientIDByName(&ca.Subject))
+	}
+	for _, ca := range removed {
+		log.Printf("info: tls: removed ca-cert %q", clientIDByName(&ca.Subject))
+	}
+	if creds.crls != nil {
+		log.Printf("info: tls: loaded crls, %d revoked certs", creds.crls.nrevoked())
+	}
+	if old.clientAuth != creds.clientAuth {
+		log.Printf("info: tls: client-auth changed: %v => %v", old.clientAuth, creds.clientAuth)
+	}
+}
+
+// diffCerts returns the certs which are only in 'b' ('added') and
+// the ones which are only in 'a' ('removed')
+func diffCerts(a, b []*x509.Certificate) (added, removed []*x509.Certificate) {
+	contains := func(certs []*x509.Certificate, cert *x509.Certificate) bool {
+		for _, c := range certs {
+			if c.Equal(cert) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, cert := range b {
+		if !contains(a, cert) {
+			added = append(added, cert)
+		}
+	}
+	for _, cert := range a {
+		if !contains(b, cert) {
+			removed = append(removed, cert)
+		}
+	}
+	return added, removed
 }
@@ -0,0 +1,112 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2016, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+// tlsProfile is a set of tls settings, see -tls-profile. the profiles
+// follow https://wiki.mozilla.org/Security/Server_Side_TLS
+type tlsProfile struct {
+	name         string
+	minVersion   uint16
+	cipherSuites []uint16 // tls1.2 and below, the suites of tls1.3 are fixed
+	curves       []tls.CurveID
+}
+
+var tlsProfiles = []tlsProfile{
+	// tls1.3 only
+	{name: "modern", minVersion: tls.VersionTLS13},
+
+	// tls1.2 and tls1.3, forward secrecy and AEAD only
+	{name: "intermediate", minVersion: tls.VersionTLS12,
+		cipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+		},
+		curves: []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384},
+	},
+
+	// the former settings of kellner plus the AEAD suites, for old opkg /
+	// libcurl builds which can't do tls1.2 or AEAD. tls1.0 stays disabled
+	// (beast, poodle)
+	{name: "legacy", minVersion: tls.VersionTLS11,
+		cipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+		},
+	},
+}
+
+func tlsProfileNames() []string {
+	var names = make([]string, len(tlsProfiles))
+	for i := range tlsProfiles {
+		names[i] = tlsProfiles[i].name
+	}
+	return names
+}
+
+func tlsProfileByName(name string) (*tlsProfile, error) {
+	for i := range tlsProfiles {
+		if tlsProfiles[i].name == name {
+			return &tlsProfiles[i], nil
+		}
+	}
+	return nil, fmt.Errorf("unknown tls profile %q, use one of %s", name, strings.Join(tlsProfileNames(), ", "))
+}
+
+// applyTo puts the profile (and the offered application protocols,
+// "h2" if 'http2') into 'config'
+func (profile *tlsProfile) applyTo(config *tls.Config, http2 bool) {
+	config.MinVersion = profile.minVersion
+	config.MaxVersion = tls.VersionTLS13
+	config.CipherSuites = profile.cipherSuites
+	config.CurvePreferences = profile.curves
+	config.NextProtos = []string{"http/1.1"}
+	if http2 {
+		config.NextProtos = []string{"h2", "http/1.1"}
+	}
+}
+
+// describeTLSConfig returns a one-line summary of the policy of 'config'
+func describeTLSConfig(profile string, config *tls.Config) string {
+
+	var suites = "go defaults"
+	if len(config.CipherSuites) > 0 {
+		var names = make([]string, len(config.CipherSuites))
+		for i, id := range config.CipherSuites {
+			names[i] = tls.CipherSuiteName(id)
+		}
+		suites = strings.Join(names, ",")
+	}
+	if config.MinVersion >= tls.VersionTLS13 {
+		suites = "tls1.3 suites"
+	}
+
+	return fmt.Sprintf("tls profile %q: %s - %s, cipher suites: %s, alpn: %s",
+		profile, tls.VersionName(config.MinVersion), tls.VersionName(config.MaxVersion),
+		suites, strings.Join(config.NextProtos, ","))
+}
@@ -0,0 +1,57 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2016, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto/tls"
+	"strings"
+	"testing"
+)
+
+func TestTLSProfiles(t *testing.T) {
+
+	if _, err := tlsProfileByName("foo"); err == nil {
+		t.Errorf("expected an error for an unknown profile")
+	}
+
+	samples := []struct {
+		name       string
+		minVersion uint16
+		aeadOnly   bool
+	}{
+		{"modern", tls.VersionTLS13, true},
+		{"intermediate", tls.VersionTLS12, true},
+		{"legacy", tls.VersionTLS11, false},
+	}
+
+	for _, sample := range samples {
+		profile, err := tlsProfileByName(sample.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var config tls.Config
+		profile.applyTo(&config, true)
+		if config.MinVersion != sample.minVersion || config.MaxVersion != tls.VersionTLS13 {
+			t.Errorf("%s: expected %s - TLS 1.3, got %s - %s", sample.name, tls.VersionName(sample.minVersion),
+				tls.VersionName(config.MinVersion), tls.VersionName(config.MaxVersion))
+		}
+		if len(config.NextProtos) == 0 || config.NextProtos[0] != "h2" {
+			t.Errorf("%s: expected \"h2\" to be offered, got %v", sample.name, config.NextProtos)
+		}
+
+		for _, id := range config.CipherSuites {
+			name := tls.CipherSuiteName(id)
+			aead := strings.Contains(name, "_GCM_") || strings.Contains(name, "_CHACHA20_POLY1305")
+			if sample.aeadOnly && (!aead || !strings.HasPrefix(name, "TLS_ECDHE_")) {
+				t.Errorf("%s: expected ECDHE and AEAD only, got %s", sample.name, name)
+			}
+		}
+	}
+}
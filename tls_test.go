@@ -0,0 +1,225 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2016, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// mockPEM writes 'raw' PEM encoded as 'typ' to 'dir'/'name'
+func mockPEM(t *testing.T, dir, name, typ string, raw []byte) string {
+	fileName := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(fileName, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return fileName
+}
+
+// mockCert creates a cert for 'name' signed by 'parent' or, if 'parent'
+// is nil, a self-signed ca-cert. 'key' is used for both sides.
+func mockCert(t *testing.T, key *ecdsa.PrivateKey, serial int64, name string, parent *x509.Certificate) ([]byte, *x509.Certificate) {
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  parent == nil,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		parent = tmpl
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(raw)
+	return raw, cert
+}
+
+// -tls-client-ca-file alone does not change the handshake, client-certs
+// are asked for only if something uses them
+func TestTLSClientAuth(t *testing.T) {
+
+	tmp, err := ioutil.TempDir("", "kellner-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		key, _    = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		rawKey, _ = x509.MarshalECPrivateKey(key)
+		rawCA, ca = mockCert(t, key, 1, "ca", nil)
+		rawSrv, _ = mockCert(t, key, 2, "localhost", ca)
+		keyFile   = mockPEM(t, tmp, "server.key", "EC PRIVATE KEY", rawKey)
+		certFile  = mockPEM(t, tmp, "server.crt", "CERTIFICATE", rawSrv)
+		caFile    = mockPEM(t, tmp, "ca.crt", "CERTIFICATE", rawCA)
+	)
+
+	samples := []struct {
+		caFile   string
+		ask      bool
+		require  bool
+		expected tls.ClientAuthType
+	}{
+		{"", false, false, tls.NoClientCert},
+		{"", true, false, tls.NoClientCert},
+		{caFile, false, false, tls.NoClientCert},
+		{caFile, true, false, tls.VerifyClientCertIfGiven},
+		{"", false, true, tls.RequireAnyClientCert},
+		{caFile, true, true, tls.RequireAndVerifyClientCert},
+	}
+	for i, sample := range samples {
+		creds, err := loadTLSCredentials(&tlsOptions{
+			keyFileName:       keyFile,
+			certFileName:      certFile,
+			clientCasFileName: sample.caFile,
+			askClientCert:     sample.ask,
+			requireClientCert: sample.require,
+		})
+		if err != nil {
+			t.Fatalf("sample %d: %v", i, err)
+		}
+		if creds.clientAuth != sample.expected {
+			t.Errorf("sample %d: expected %v, got %v", i, sample.expected, creds.clientAuth)
+		}
+	}
+}
+
+// a client-cert revoked after the first handshake must not be accepted
+// via session resumption
+func TestTLSRevokedResumption(t *testing.T) {
+
+	tmp, err := ioutil.TempDir("", "kellner-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rawKey, _ := x509.MarshalECPrivateKey(key)
+	writePEM := func(name, typ string, raw []byte) string {
+		return mockPEM(t, tmp, name, typ, raw)
+	}
+	mkCert := func(serial int64, name string, parent *x509.Certificate) ([]byte, *x509.Certificate) {
+		return mockCert(t, key, serial, name, parent)
+	}
+	rawCA, ca := mkCert(1, "ca", nil)
+	writeCRL := func(revoked ...int64) {
+		var entries []x509.RevocationListEntry
+		for _, serial := range revoked {
+			entries = append(entries, x509.RevocationListEntry{SerialNumber: big.NewInt(serial), RevocationTime: time.Now()})
+		}
+		raw, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+			Number:                    big.NewInt(int64(len(revoked) + 1)),
+			ThisUpdate:                time.Now(),
+			NextUpdate:                time.Now().Add(time.Hour),
+			RevokedCertificateEntries: entries,
+		}, ca, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writePEM("ca.crl", "X509 CRL", raw)
+	}
+
+	var (
+		rawSrv, _   = mkCert(2, "localhost", ca)
+		rawCli, _   = mkCert(3, "client", ca)
+		clientCert  = tls.Certificate{Certificate: [][]byte{rawCli}, PrivateKey: key}
+		clientCAs   = x509.NewCertPool()
+		clientCache = tls.NewLRUClientSessionCache(4)
+	)
+	clientCAs.AddCert(ca)
+	writeCRL()
+
+	opts := &tlsOptions{
+		keyFileName:       writePEM("server.key", "EC PRIVATE KEY", rawKey),
+		certFileName:      writePEM("server.crt", "CERTIFICATE", rawSrv),
+		clientCasFileName: writePEM("ca.crt", "CERTIFICATE", rawCA),
+		crlFileNames:      []string{filepath.Join(tmp, "ca.crl")},
+		requireClientCert: true,
+		profile:           "intermediate",
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsListener, reloader, err := initTLS(listener, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tlsListener.Close()
+
+	go func() {
+		for {
+			conn, err := tlsListener.Accept()
+			if err != nil {
+				return
+			}
+			if conn.(*tls.Conn).Handshake() == nil {
+				conn.Write([]byte("ok"))
+			}
+			conn.Close()
+		}
+	}()
+
+	// dial returns if the server accepted the handshake and if the
+	// session was resumed
+	dial := func() (bool, bool) {
+		conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{
+			ServerName:         "localhost",
+			RootCAs:            clientCAs,
+			Certificates:       []tls.Certificate{clientCert},
+			ClientSessionCache: clientCache,
+		})
+		if err != nil {
+			return false, false
+		}
+		defer conn.Close()
+		var buf = make([]byte, 2)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.Read(buf)
+		return err == nil && string(buf) == "ok", conn.ConnectionState().DidResume
+	}
+
+	if ok, _ := dial(); !ok {
+		t.Fatalf("expected the valid client-cert to be accepted")
+	}
+	if ok, resumed := dial(); !ok || !resumed {
+		t.Fatalf("expected the session to be resumed (accepted: %v, resumed: %v)", ok, resumed)
+	}
+
+	writeCRL(3)
+	creds, err := loadTLSCredentials(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloader.Apply(creds)
+	if ok, _ := dial(); ok {
+		t.Errorf("expected the revoked client-cert to be rejected on resumption")
+	}
+}
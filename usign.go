@@ -0,0 +1,103 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2016, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// usignKey is an ed25519 secret key in the format used by usign (OpenWrt)
+// and signify (OpenBSD). the key-file looks like this:
+//
+//	untrusted comment: <some comment>
+//	<base64 encoded key>
+//
+// the decoded key is laid out as:
+//
+//	pkalg[2] "Ed" | kdfalg[2] "BK" | kdfrounds[4] | salt[16] |
+//	checksum[8] | fingerprint[8] | seckey[64]
+type usignKey struct {
+	Fingerprint [8]byte
+	Key         ed25519.PrivateKey
+}
+
+const (
+	_UsignSecKeyLen = 2 + 2 + 4 + 16 + 8 + 8 + ed25519.PrivateKeySize
+	_UsignComment   = "untrusted comment: "
+)
+
+func loadUsignKey(fileName string) (*usignKey, error) {
+
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := decodeUsignBlob(content)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %q: %v", fileName, err)
+	}
+
+	if len(raw) != _UsignSecKeyLen {
+		return nil, fmt.Errorf("parsing %q: unexpected key length %d", fileName, len(raw))
+	}
+	if string(raw[0:2]) != "Ed" {
+		return nil, fmt.Errorf("parsing %q: unsupported public key algorithm %q", fileName, raw[0:2])
+	}
+	if kdfrounds := binary.BigEndian.Uint32(raw[4:8]); kdfrounds != 0 {
+		return nil, fmt.Errorf("parsing %q: encrypted keys are not supported", fileName)
+	}
+
+	var (
+		key      = &usignKey{Key: ed25519.PrivateKey(raw[40:])}
+		checksum = sha512.Sum512(key.Key)
+	)
+	if !bytes.Equal(checksum[:8], raw[24:32]) {
+		return nil, fmt.Errorf("parsing %q: checksum mismatch", fileName)
+	}
+	copy(key.Fingerprint[:], raw[32:40])
+
+	return key, nil
+}
+
+// SignatureTo signs 'msg' and writes the signature in usign format to 'w'
+func (key *usignKey) SignatureTo(w io.Writer, msg []byte) error {
+
+	var blob = bytes.NewBuffer(nil)
+	blob.WriteString("Ed")
+	blob.Write(key.Fingerprint[:])
+	blob.Write(ed25519.Sign(key.Key, msg))
+
+	_, err := fmt.Fprintf(w, "%ssigned by key %x\n%s\n", _UsignComment, key.Fingerprint,
+		base64.StdEncoding.EncodeToString(blob.Bytes()))
+	return err
+}
+
+// decodeUsignBlob skips the "untrusted comment" line and decodes
+// the base64 encoded content of the following line
+func decodeUsignBlob(content []byte) ([]byte, error) {
+
+	var scanner = bufio.NewScanner(bytes.NewReader(content))
+	if !scanner.Scan() || !strings.HasPrefix(scanner.Text(), _UsignComment) {
+		return nil, fmt.Errorf("missing %q line", strings.TrimSpace(_UsignComment))
+	}
+	if !scanner.Scan() {
+		return nil, fmt.Errorf("missing base64 encoded content")
+	}
+	return base64.StdEncoding.DecodeString(strings.TrimSpace(scanner.Text()))
+}
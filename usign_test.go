@@ -0,0 +1,68 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2016, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestUsignSignature(t *testing.T) {
+
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	fingerprint := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	checksum := sha512.Sum512(priv)
+
+	raw := bytes.NewBuffer(nil)
+	raw.WriteString("EdBK")
+	raw.Write(make([]byte, 4+16)) // kdfrounds + salt
+	raw.Write(checksum[:8])
+	raw.Write(fingerprint)
+	raw.Write(priv)
+
+	keyFile, err := ioutil.TempFile("", "kellner-usign")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(keyFile.Name())
+	fmt.Fprintf(keyFile, "untrusted comment: test key\n%s\n", base64.StdEncoding.EncodeToString(raw.Bytes()))
+	keyFile.Close()
+
+	key, err := loadUsignKey(keyFile.Name())
+	if err != nil {
+		t.Fatalf("loadUsignKey(): %v", err)
+	}
+
+	msg := []byte("Package: foo\n\n")
+	sig := bytes.NewBuffer(nil)
+	if err = key.SignatureTo(sig, msg); err != nil {
+		t.Fatalf("SignatureTo(): %v", err)
+	}
+
+	blob, err := decodeUsignBlob(sig.Bytes())
+	if err != nil {
+		t.Fatalf("decoding signature %q: %v", sig.String(), err)
+	}
+	if len(blob) != 2+8+ed25519.SignatureSize || string(blob[:2]) != "Ed" {
+		t.Fatalf("unexpected signature layout: %x", blob)
+	}
+	if !bytes.Equal(blob[2:10], fingerprint) {
+		t.Fatalf("expected fingerprint %x, got %x", fingerprint, blob[2:10])
+	}
+	if !ed25519.Verify(pub, msg, blob[10:]) {
+		t.Fatal("signature does not verify")
+	}
+}
@@ -0,0 +1,67 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2016, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"log"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// dirWatcher collects change-notifications for directories below
+// root. a directory is rescanned after no further change happened
+// for 'delay'. this way a burst of uploads leads to only one rescan.
+type dirWatcher struct {
+	root  string
+	cache string
+	opts  *scanOptions
+	delay time.Duration
+
+	mu      sync.Mutex
+	pending map[string]*time.Timer
+}
+
+func newDirWatcher(root, cache string, opts *scanOptions, delay time.Duration) *dirWatcher {
+	return &dirWatcher{
+		root:    root,
+		cache:   cache,
+		opts:    opts,
+		delay:   delay,
+		pending: make(map[string]*time.Timer),
+	}
+}
+
+// skip returns true for directories which are not to be watched
+func (dw *dirWatcher) skip(dir string) bool {
+	return isSubPath(dir, dw.cache) || isStagingName(filepath.Base(dir))
+}
+
+// touch (re)schedules the rescan of 'dir'
+func (dw *dirWatcher) touch(dir string) {
+	dw.mu.Lock()
+	defer dw.mu.Unlock()
+
+	if timer, exists := dw.pending[dir]; exists {
+		timer.Reset(dw.delay)
+		return
+	}
+	dw.pending[dir] = time.AfterFunc(dw.delay, func() { dw.rescanDir(dir) })
+}
+
+func (dw *dirWatcher) rescanDir(dir string) {
+	dw.mu.Lock()
+	delete(dw.pending, dir)
+	dw.mu.Unlock()
+
+	log.Printf("info: change detected, rescanning %q", dir)
+	if err := scanDir(dw.root, dw.cache, dir, dw.opts); err != nil {
+		log.Printf("error: %v", err)
+	}
+}
@@ -0,0 +1,121 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2016, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+const _InotifyMask = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO |
+	syscall.IN_MOVED_FROM | syscall.IN_DELETE | syscall.IN_CREATE |
+	syscall.IN_DELETE_SELF
+
+// watch adds an inotify-watch to every directory below root and
+// schedules a rescan of a directory whenever a package in it got
+// written, moved or deleted. watch blocks until an error occurs.
+func (dw *dirWatcher) watch() error {
+
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return fmt.Errorf("inotify_init: %v", err)
+	}
+	defer syscall.Close(fd)
+
+	var dirs = make(map[int]string) // watch-descriptor => directory
+
+	// the watch is added before the entries of a directory are read,
+	// a sub-directory created in between is either read or reported.
+	// filepath.Walk() reads the entries first and misses it.
+	var addTree func(dir string, scan bool)
+	addTree = func(dir string, scan bool) {
+		if dw.skip(dir) {
+			return
+		}
+		wd, err := syscall.InotifyAddWatch(fd, dir, _InotifyMask)
+		if err != nil {
+			log.Printf("error: watching %q: %v", dir, err)
+			return
+		}
+		dirs[wd] = dir
+		if scan {
+			dw.touch(dir)
+		}
+		entries, _ := ioutil.ReadDir(dir)
+		for _, entry := range entries {
+			if entry.IsDir() {
+				addTree(filepath.Join(dir, entry.Name()), scan)
+			}
+		}
+	}
+
+	addTree(dw.root, false)
+	log.Printf("watching %d directories below %q", len(dirs), dw.root)
+
+	var buf [syscall.SizeofInotifyEvent * 4096]byte
+	for {
+		n, err := syscall.Read(fd, buf[:])
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("reading inotify events: %v", err)
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameBytes := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(event.Len)]
+			offset += syscall.SizeofInotifyEvent + int(event.Len)
+
+			// the kernel dropped events: everything might have changed,
+			// (re)add the watches and rescan all directories
+			if event.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				log.Printf("warning: inotify queue overflow, rescanning %q", dw.root)
+				addTree(dw.root, true)
+				continue
+			}
+
+			dir, known := dirs[int(event.Wd)]
+			if !known {
+				continue
+			}
+			if event.Mask&syscall.IN_IGNORED != 0 {
+				delete(dirs, int(event.Wd))
+				continue
+			}
+
+			name := string(trimNul(nameBytes))
+			path := filepath.Join(dir, name)
+
+			switch {
+			case event.Mask&syscall.IN_ISDIR != 0:
+				if event.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 && !dw.skip(path) {
+					addTree(path, true)
+				}
+			case event.Mask&syscall.IN_CREATE != 0:
+				// wait for IN_CLOSE_WRITE
+			case isPackageName(name):
+				dw.touch(dir)
+			}
+		}
+	}
+}
+
+func trimNul(b []byte) []byte {
+	for i := range b {
+		if b[i] == 0 {
+			return b[:i]
+		}
+	}
+	return b
+}
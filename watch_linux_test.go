@@ -0,0 +1,45 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2016, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// a package written into a directory created after the start of the
+// watcher leads to the index of that directory
+func TestWatch(t *testing.T) {
+
+	root, cache, cleanup := mockRoot(t)
+	defer cleanup()
+
+	dw := newDirWatcher(root, cache, &scanOptions{nworkers: 1, gzipper: gzGolang}, 50*time.Millisecond)
+	go dw.watch()
+	time.Sleep(100 * time.Millisecond)
+
+	var (
+		sub = filepath.Join(root, "stable", "armv7")
+		gz  = func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }
+	)
+	if err := os.MkdirAll(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := ioutil.WriteFile(filepath.Join(sub, "foo_1.0-r0_all.ipk"), mockIpk(t, "control.tar.gz", gz), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, filepath.Join(cache, "stable", "armv7", "Packages"), 5*time.Second)
+}
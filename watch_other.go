@@ -0,0 +1,18 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2016, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build !linux
+// +build !linux
+
+package main
+
+import "fmt"
+
+func (dw *dirWatcher) watch() error {
+	return fmt.Errorf("watching directories is only supported on linux")
+}
@@ -0,0 +1,108 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2016, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// mockRoot creates a -root with one package and returns root, cache
+// and a function to remove everything
+func mockRoot(t *testing.T) (string, string, func()) {
+
+	tmp, err := ioutil.TempDir("", "kellner-watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		root  = filepath.Join(tmp, "root")
+		cache = filepath.Join(tmp, "cache")
+		gz    = func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }
+	)
+	os.MkdirAll(root, 0755)
+	if err = ioutil.WriteFile(filepath.Join(root, "foo_1.0-r0_all.ipk"), mockIpk(t, "control.tar.gz", gz), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return root, cache, func() { os.RemoveAll(tmp) }
+}
+
+// waitFor polls 'name' until it exists
+func waitFor(t *testing.T, name string, timeout time.Duration) {
+	for start := time.Now(); time.Since(start) < timeout; time.Sleep(10 * time.Millisecond) {
+		if _, err := os.Stat(name); err == nil {
+			return
+		}
+	}
+	t.Fatalf("%q did not show up within %s", name, timeout)
+}
+
+func TestDirWatcherTouch(t *testing.T) {
+
+	root, cache, cleanup := mockRoot(t)
+	defer cleanup()
+
+	dw := newDirWatcher(root, cache, &scanOptions{nworkers: 1, gzipper: gzGolang}, 50*time.Millisecond)
+	if !dw.skip(filepath.Join(cache, "sub")) || !dw.skip(filepath.Join(root, ".kellner-staging-1")) || dw.skip(root) || dw.skip(cache+"2") {
+		t.Errorf("skip(): expected to skip the cache and staging dirs only")
+	}
+
+	// a burst of changes leads to one pending rescan
+	for i := 0; i < 5; i++ {
+		dw.touch(root)
+	}
+	dw.mu.Lock()
+	if len(dw.pending) != 1 {
+		t.Errorf("expected 1 pending rescan, got %d", len(dw.pending))
+	}
+	dw.mu.Unlock()
+
+	waitFor(t, filepath.Join(cache, "Packages"), 5*time.Second)
+}
+
+// concurrent scans of the same directory must not mix the index files
+// of different scans
+func TestScanDirConcurrent(t *testing.T) {
+
+	root, cache, cleanup := mockRoot(t)
+	defer cleanup()
+
+	key, err := openpgp.NewEntity("kellner", "test", "kellner@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &scanOptions{nworkers: 1, gzipper: gzGolang, pgpKey: key}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := scanDir(root, cache, root, opts); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	release, _ := ioutil.ReadFile(filepath.Join(cache, "Release"))
+	sig, _ := ioutil.ReadFile(filepath.Join(cache, "Release.gpg"))
+	if _, err = openpgp.CheckArmoredDetachedSignature(openpgp.EntityList{key}, bytes.NewReader(release), bytes.NewReader(sig)); err != nil {
+		t.Errorf("Release.gpg does not match Release: %v", err)
+	}
+}
@@ -10,23 +10,113 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"strings"
 )
 
 // returns a "normalized" variant of the pkix.Name
 // which might be used as a file on disk
 func clientIDByName(name *pkix.Name) string {
 
-	nameBytes := typeValsToBytes(name.Names, true)
+	nameBytes := typeValsToBytes(name.Names, true, false)
 	return string(nameBytes)
 }
 
-func printClientIDTo(w io.Writer, certFile string) error {
+// clientIDFunc derives the client-id from a client-cert (-client-id).
+// it returns "" if the cert does not carry the needed information.
+type clientIDFunc func(cert *x509.Certificate) string
+
+// of returns the client-id of 'cert'. a nil clientIDFunc uses
+// the subject of 'cert'.
+func (f clientIDFunc) of(cert *x509.Certificate) string {
+	if f == nil {
+		return clientIDByName(&cert.Subject)
+	}
+	return f(cert)
+}
+
+// clientIDSources lists the ways to derive a client-id from a
+// client-cert. each returns all candidates, the first one is
+// used as client-id.
+var clientIDSources = []struct {
+	name string
+	ids  func(cert *x509.Certificate) []string
+}{
+	{"subject", func(cert *x509.Certificate) []string {
+		return []string{clientIDByName(&cert.Subject)}
+	}},
+	{"subject-full", func(cert *x509.Certificate) []string {
+		return []string{string(typeValsToBytes(cert.Subject.Names, true, true))}
+	}},
+	{"san-dns", func(cert *x509.Certificate) []string {
+		return keyedIDs("DNS", cert.DNSNames)
+	}},
+	{"san-email", func(cert *x509.Certificate) []string {
+		return keyedIDs("EMAIL", cert.EmailAddresses)
+	}},
+	{"san-ip", func(cert *x509.Certificate) []string {
+		var ips []string
+		for _, ip := range cert.IPAddresses {
+			ips = append(ips, ip.String())
+		}
+		return keyedIDs("IP", ips)
+	}},
+	{"san-uri", func(cert *x509.Certificate) []string {
+		var uris []string
+		for _, uri := range cert.URIs {
+			uris = append(uris, uri.String())
+		}
+		return keyedIDs("URI", uris)
+	}},
+	{"sha256-cert", func(cert *x509.Certificate) []string {
+		return []string{fmt.Sprintf("CERT-SHA256=%x", sha256.Sum256(cert.Raw))}
+	}},
+	{"sha256-pubkey", func(cert *x509.Certificate) []string {
+		return []string{fmt.Sprintf("PUBKEY-SHA256=%x", sha256.Sum256(cert.RawSubjectPublicKeyInfo))}
+	}},
+}
+
+// clientIDFuncByName returns the clientIDFunc for one of the
+// clientIDSources
+func clientIDFuncByName(source string) (clientIDFunc, error) {
+	var names []string
+	for _, s := range clientIDSources {
+		if s.name == source {
+			var ids = s.ids
+			return func(cert *x509.Certificate) string {
+				if candidates := ids(cert); len(candidates) > 0 {
+					return candidates[0]
+				}
+				return ""
+			}, nil
+		}
+		names = append(names, s.name)
+	}
+	return nil, fmt.Errorf("unknown client-id source %q (use one of %s)", source, strings.Join(names, ", "))
+}
+
+// keyedIDs returns "key=value" for each of 'values', the values are
+// cleaned like the ones of the subject
+func keyedIDs(key string, values []string) []string {
+	var ids []string
+	for _, value := range values {
+		id := []byte(key + "=" + value)
+		cleanPkixNameBytes(id[len(key)+1:])
+		ids = append(ids, string(id))
+	}
+	return ids
+}
+
+// printClientIDTo prints all candidates for the client-id of the
+// cert in 'certFile', one line per candidate: "source client-id".
+// the candidate used by 'source' is marked.
+func printClientIDTo(w io.Writer, certFile, source string) error {
 	var (
 		cert          *x509.Certificate
 		block         *pem.Block
@@ -36,6 +126,9 @@ func printClientIDTo(w io.Writer, certFile string) error {
 	if err != nil {
 		return err
 	}
+	if _, err = clientIDFuncByName(source); err != nil {
+		return err
+	}
 
 	for {
 		block, rawBytes = pem.Decode(rawBytes)
@@ -47,7 +140,7 @@ func printClientIDTo(w io.Writer, certFile string) error {
 		}
 
 		if cert, err = x509.ParseCertificate(block.Bytes); err != nil {
-			return nil
+			return err
 		}
 
 		break
@@ -57,8 +150,15 @@ func printClientIDTo(w io.Writer, certFile string) error {
 		return fmt.Errorf("cert file %q does not contain a certificate", certFile)
 	}
 
-	clientID := clientIDByName(&cert.Subject)
-	fmt.Fprintf(w, "%s\n", clientID)
+	for _, s := range clientIDSources {
+		for i, clientID := range s.ids(cert) {
+			var marker string
+			if s.name == source && i == 0 {
+				marker = " (-client-id)"
+			}
+			fmt.Fprintf(w, "%-14s %s%s\n", s.name, clientID, marker)
+		}
+	}
 
 	return nil
 }
@@ -85,7 +185,9 @@ var oidToKeys = [...]struct {
 // asn1.object-identifier ("key") in the form:
 //  key1=value1,key2=value2,key3=value3...
 //
-func typeValsToBytes(names []pkix.AttributeTypeAndValue, cleanValues bool) []byte {
+// unknown object-identifiers are dropped unless 'unknownOIDs' is set,
+// then their dotted form is used as key (eg. "2.5.4.42=value").
+func typeValsToBytes(names []pkix.AttributeTypeAndValue, cleanValues, unknownOIDs bool) []byte {
 
 	buf := bytes.NewBuffer(nil)
 	for i := range names {
@@ -104,6 +206,9 @@ func typeValsToBytes(names []pkix.AttributeTypeAndValue, cleanValues bool) []byt
 			}
 		}
 
+		if key == "" && unknownOIDs {
+			key = entry.Type.String()
+		}
 		if key == "" {
 			continue
 		}
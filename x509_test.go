@@ -0,0 +1,163 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mockSANCert creates a self-signed cert for "dev 1" carrying the
+// given SANs
+func mockSANCert(t *testing.T, dns, emails []string, ips []net.IP, uris []string) ([]byte, *x509.Certificate) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{
+			Organization: []string{"acme.org"},
+			CommonName:   "dev 1",
+			ExtraNames:   []pkix.AttributeTypeAndValue{{Type: asn1.ObjectIdentifier{2, 5, 4, 42}, Value: "Jo"}},
+		},
+		DNSNames:       dns,
+		EmailAddresses: emails,
+		IPAddresses:    ips,
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+	}
+	for _, uri := range uris {
+		u, err := url.Parse(uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmpl.URIs = append(tmpl.URIs, u)
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(raw)
+	return raw, cert
+}
+
+func TestClientIDSources(t *testing.T) {
+
+	var (
+		_, cert = mockSANCert(t,
+			[]string{"dev1.acme.org", "dev1.local"},
+			[]string{"ops@acme.org"},
+			[]net.IP{net.ParseIP("10.0.0.1")},
+			[]string{"urn:dev/../x"})
+		_, bare = mockSANCert(t, nil, nil, nil, nil)
+	)
+
+	samples := []struct {
+		source   string
+		expected string
+	}{
+		{"subject", "O=acme_org,CN=dev_1"},
+		{"subject-full", "O=acme_org,CN=dev_1,2.5.4.42=Jo"},
+		{"san-dns", "DNS=dev1_acme_org"},
+		{"san-email", "EMAIL=ops_acme_org"},
+		{"san-ip", "IP=10_0_0_1"},
+		{"san-uri", "URI=urn_dev____x"},
+		{"sha256-cert", fmt.Sprintf("CERT-SHA256=%x", sha256.Sum256(cert.Raw))},
+		{"sha256-pubkey", fmt.Sprintf("PUBKEY-SHA256=%x", sha256.Sum256(cert.RawSubjectPublicKeyInfo))},
+	}
+
+	for _, s := range samples {
+		clientID, err := clientIDFuncByName(s.source)
+		if err != nil {
+			t.Errorf("%s: %v", s.source, err)
+			continue
+		}
+		if id := clientID.of(cert); id != s.expected {
+			t.Errorf("%s: expected %q, got %q", s.source, s.expected, id)
+		}
+		// a cert without the SAN yields no client-id at all
+		if strings.HasPrefix(s.source, "san-") {
+			if id := clientID.of(bare); id != "" {
+				t.Errorf("%s: expected no client-id without the SAN, got %q", s.source, id)
+			}
+		}
+	}
+
+	if _, err := clientIDFuncByName("san-foo"); err == nil {
+		t.Errorf("expected an error for an unknown source")
+	}
+}
+
+func TestKeyedIDs(t *testing.T) {
+	ids := keyedIDs("URI", []string{"urn:dev/../x", "a=b,c"})
+	expected := []string{"URI=urn_dev____x", "URI=a_b_c"}
+	if strings.Join(ids, "|") != strings.Join(expected, "|") {
+		t.Errorf("expected %q, got %q", expected, ids)
+	}
+	if ids = keyedIDs("DNS", nil); len(ids) != 0 {
+		t.Errorf("expected no ids, got %q", ids)
+	}
+}
+
+// all candidates are printed, only the first one of the chosen
+// source is marked
+func TestPrintClientID(t *testing.T) {
+
+	tmp, err := ioutil.TempDir("", "kellner-x509")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		raw, _   = mockSANCert(t, []string{"dev1.acme.org", "dev1.local"}, nil, nil, nil)
+		certFile = mockPEM(t, tmp, "client.crt", "CERTIFICATE", raw)
+		out      = bytes.NewBuffer(nil)
+	)
+
+	if err = printClientIDTo(out, certFile, "san-dns"); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"san-dns        DNS=dev1_acme_org (-client-id)\n",
+		"san-dns        DNS=dev1_local\n",
+		"subject        O=acme_org,CN=dev_1\n",
+	} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("expected %q in\n%s", line, out.String())
+		}
+	}
+	if n := strings.Count(out.String(), "(-client-id)"); n != 1 {
+		t.Errorf("expected one marker, got %d in\n%s", n, out.String())
+	}
+	if strings.Contains(out.String(), "san-email") {
+		t.Errorf("expected no san-email candidate in\n%s", out.String())
+	}
+
+	if err = printClientIDTo(out, certFile, "san-foo"); err == nil {
+		t.Errorf("expected an error for an unknown source")
+	}
+	keyFile := mockPEM(t, tmp, "client.key", "EC PRIVATE KEY", []byte("nokey"))
+	if err = printClientIDTo(out, keyFile, "subject"); err == nil {
+		t.Errorf("expected an error for a file without a cert")
+	}
+}